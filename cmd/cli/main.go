@@ -1,13 +1,30 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/robalyx/roscoe/internal/cli"
+	"github.com/robalyx/roscoe/internal/service/d1"
 )
 
+var (
+	errInvalidTime  = errors.New("expected a duration such as 720h or a date such as 2006-01-02")
+	errExpiryInPast = errors.New("expiry must be in the future")
+)
+
+// version is the CLI version recorded with every sync run. It can be set at
+// build time with -ldflags "-X main.version=...".
+var version string
+
 func main() {
 	log.SetFlags(0) // Remove timestamp prefix from log messages
 
@@ -22,35 +39,71 @@ func main() {
 	d1ID := getEnvOrFatal("ROSCOE_CF_D1_ID")
 	token := getEnvOrFatal("ROSCOE_CF_API_TOKEN")
 
+	apiOpts := []d1.Option{d1.WithRetryPolicy(loadRetryPolicy())}
+	if baseURL := os.Getenv("ROSCOE_CF_API_BASE_URL"); baseURL != "" {
+		apiOpts = append(apiOpts, d1.WithBaseURL(baseURL))
+	}
+	cfAPI := d1.NewCloudflareAPI(accountID, d1ID, token, apiOpts...)
+
 	// Parse command line arguments
 	if len(os.Args) < 2 {
-		log.Fatal("Command required: sync, add-key, remove-key, or list-keys")
+		log.Fatal("Command required: sync, sync-history, migrate, add-key, remove-key, rotate-key, disable-key, " +
+			"enable-key, list-keys, usage, list-snapshots, or rollback")
 	}
 
 	command := os.Args[1]
 	switch command {
 	case "sync":
-		if err := cli.RunSync(dbURL, accountID, d1ID, token); err != nil {
-			log.Fatalf("❌ Sync failed: %v", err)
+		runSync(dbURL, cfAPI, os.Args[2:])
+	case "migrate":
+		migrateFlags := flag.NewFlagSet("migrate", flag.ExitOnError)
+		dropShortKeys := migrateFlags.Bool("drop-short-keys", false,
+			fmt.Sprintf("remove plaintext API keys shorter than %d characters instead of failing", d1.MinKeyLength))
+		_ = migrateFlags.Parse(os.Args[2:])
+
+		if err := cli.Migrate(cfAPI, *dropShortKeys); err != nil {
+			log.Fatalf("❌ Migration failed: %v", err)
 		}
 	case "add-key":
-		if len(os.Args) < 3 {
-			log.Fatal("Usage: add-key <description>")
-		}
-		if err := cli.AddAPIKey(accountID, d1ID, token, os.Args[2]); err != nil {
-			log.Fatalf("❌ Failed to add API key: %v", err)
-		}
+		runAddKey(cfAPI, os.Args[2:])
 	case "remove-key":
-		if len(os.Args) < 3 {
-			log.Fatal("Usage: remove-key <key>")
-		}
-		if err := cli.RemoveAPIKey(accountID, d1ID, token, os.Args[2]); err != nil {
+		ref := parseKeyRef(command, os.Args[2:])
+		if err := cli.RemoveAPIKey(cfAPI, ref); err != nil {
 			log.Fatalf("❌ Failed to remove API key: %v", err)
 		}
+	case "rotate-key":
+		runRotateKey(cfAPI, os.Args[2:])
+	case "disable-key", "enable-key":
+		ref := parseKeyRef(command, os.Args[2:])
+		if err := cli.SetAPIKeyDisabled(cfAPI, ref, command == "disable-key"); err != nil {
+			log.Fatalf("❌ Failed to update API key: %v", err)
+		}
 	case "list-keys":
-		if err := cli.ListAPIKeys(accountID, d1ID, token); err != nil {
+		if err := cli.ListAPIKeys(cfAPI); err != nil {
 			log.Fatalf("❌ Failed to list API keys: %v", err)
 		}
+	case "usage":
+		runUsage(cfAPI, os.Args[2:])
+	case "sync-history":
+		historyFlags := flag.NewFlagSet("sync-history", flag.ExitOnError)
+		limit := historyFlags.Int("limit", 10, "number of runs to show")
+		_ = historyFlags.Parse(os.Args[2:])
+
+		if err := cli.SyncHistory(cfAPI, *limit); err != nil {
+			log.Fatalf("❌ Failed to list sync history: %v", err)
+		}
+	case "list-snapshots":
+		if err := cli.ListSnapshots(cfAPI); err != nil {
+			log.Fatalf("❌ Failed to list snapshots: %v", err)
+		}
+	case "rollback":
+		var name string
+		if len(os.Args) > 2 {
+			name = os.Args[2]
+		}
+		if err := cli.Rollback(cfAPI, name); err != nil {
+			log.Fatalf("❌ Rollback failed: %v", err)
+		}
 	default:
 		log.Fatalf("Unknown command: %s", command)
 	}
@@ -64,3 +117,228 @@ func getEnvOrFatal(key string) string {
 	}
 	return value
 }
+
+// loadRetryPolicy returns the D1 API retry policy, applying optional overrides from the environment.
+func loadRetryPolicy() d1.RetryPolicy {
+	retry := d1.DefaultRetryPolicy()
+	if value := os.Getenv("ROSCOE_CF_MAX_ATTEMPTS"); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < 1 {
+			log.Fatalf("Environment variable ROSCOE_CF_MAX_ATTEMPTS must be a positive integer")
+		}
+		retry.MaxAttempts = attempts
+	}
+	if value := os.Getenv("ROSCOE_CF_MAX_RETRY_DELAY"); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay <= 0 {
+			log.Fatalf("Environment variable ROSCOE_CF_MAX_RETRY_DELAY must be a positive duration")
+		}
+		retry.MaxDelay = delay
+	}
+	return retry
+}
+
+// cliVersion returns the version set at build time, falling back to the VCS
+// revision embedded by the Go toolchain.
+func cliVersion() string {
+	if version != "" {
+		return version
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+			return setting.Value[:12]
+		}
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+// runSync parses the sync command's flags and syncs the database with D1.
+func runSync(dbURL string, cfAPI *d1.CloudflareAPI, args []string) {
+	syncFlags := flag.NewFlagSet("sync", flag.ExitOnError)
+	full := syncFlags.Bool("full", false, "rebuild the whole dataset and swap it into place")
+	resume := syncFlags.Bool("resume", false, "resume an interrupted full rebuild from its last checkpoint")
+	maxDrop := syncFlags.Float64("max-drop", d1.DefaultMaxDropPercent, "largest allowed drop in flags, in percent")
+	force := syncFlags.Bool("force", false, "publish the dataset even if it fails the drop check")
+	keep := syncFlags.Int("keep-snapshots", d1.DefaultKeepSnapshots, "number of replaced datasets kept for rollbacks")
+	snapshotDelta := syncFlags.Bool("snapshot-delta", false, "copy the live dataset into a snapshot before a delta sync")
+	_ = syncFlags.Parse(args)
+
+	if !(*maxDrop >= 0 && *maxDrop <= 100) {
+		log.Fatal("❌ --max-drop must be a percentage between 0 and 100")
+	}
+
+	opts := d1.SyncOptions{
+		Full:           *full,
+		Resume:         *resume,
+		MaxDropPercent: *maxDrop,
+		Force:          *force,
+		KeepSnapshots:  *keep,
+		SnapshotDelta:  *snapshotDelta,
+		Version:        cliVersion(),
+	}
+	if err := cli.RunSync(dbURL, cfAPI, opts); err != nil {
+		log.Fatalf("❌ Sync failed: %v", err)
+	}
+}
+
+// runAddKey parses the add-key command's flags and adds a new API key.
+func runAddKey(cfAPI *d1.CloudflareAPI, args []string) {
+	keyFlags := flag.NewFlagSet("add-key", flag.ExitOnError)
+	scopeList := keyFlags.String("scopes", strings.Join(d1.DefaultScopes, ","),
+		"comma separated scopes: lookup:read, queue:write, queue:process, admin")
+	expires := keyFlags.String("expires", "", "expiry as a duration from now (e.g. 720h) or a date (2006-01-02)")
+	rpm := keyFlags.Int64("rpm", 0, "requests allowed per minute, or 0 for no limit")
+	dailyIDs := keyFlags.Int64("daily-ids", 0, "user IDs that can be looked up per day, or 0 for no limit")
+	dailyQueue := keyFlags.Int64("daily-queue", 0, "users that can be queued per day, or 0 for no limit")
+	positional := parseArgs(keyFlags, args)
+
+	if len(positional) != 1 {
+		log.Fatal("Usage: add-key [--scopes lookup:read,queue:write] [--expires 720h] " +
+			"[--rpm 60] [--daily-ids 10000] [--daily-queue 1000] <description>")
+	}
+	if *rpm < 0 || *dailyIDs < 0 || *dailyQueue < 0 {
+		log.Fatal("❌ Limits can't be negative")
+	}
+	scopes, err := d1.ParseScopes(*scopeList)
+	if err != nil {
+		log.Fatalf("❌ Invalid scopes: %v", err)
+	}
+	if len(scopes) == 0 {
+		log.Fatal("❌ At least one scope is required")
+	}
+	expiresAt, err := parseExpiry(*expires)
+	if err != nil {
+		log.Fatalf("❌ Invalid expiry: %v", err)
+	}
+	opts := d1.KeyOptions{
+		Description:       positional[0],
+		Scopes:            scopes,
+		ExpiresAt:         expiresAt,
+		RequestsPerMinute: *rpm,
+		DailyIDQuota:      *dailyIDs,
+		DailyQueueQuota:   *dailyQueue,
+	}
+	if err := cli.AddAPIKey(cfAPI, opts); err != nil {
+		log.Fatalf("❌ Failed to add API key: %v", err)
+	}
+}
+
+// runRotateKey parses the rotate-key command's flags and rotates an API key.
+func runRotateKey(cfAPI *d1.CloudflareAPI, args []string) {
+	rotateFlags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	grace := rotateFlags.Duration("grace", 72*time.Hour, "how long the old key keeps working")
+	positional := parseArgs(rotateFlags, args)
+
+	if len(positional) != 1 {
+		log.Fatal("Usage: rotate-key <key-id|prefix> [--grace 72h] (put -- before a prefix that starts with -)")
+	}
+	if *grace < 0 {
+		log.Fatal("❌ Grace period can't be negative")
+	}
+	if err := cli.RotateAPIKey(cfAPI, positional[0], *grace); err != nil {
+		log.Fatalf("❌ Failed to rotate API key: %v", err)
+	}
+}
+
+// parseKeyRef returns the key ID or prefix that is the only argument of a key
+// command that takes no flags.
+func parseKeyRef(command string, args []string) string {
+	positional := parseArgs(flag.NewFlagSet(command, flag.ExitOnError), args)
+	if len(positional) != 1 {
+		log.Fatalf("Usage: %s <key-id|prefix> (put -- before a prefix that starts with -)", command)
+	}
+	return positional[0]
+}
+
+// runUsage parses the usage command's flags and prints the usage report.
+func runUsage(cfAPI *d1.CloudflareAPI, args []string) {
+	usageFlags := flag.NewFlagSet("usage", flag.ExitOnError)
+	key := usageFlags.String("key", "", "only report the key with this ID or prefix")
+	since := usageFlags.String("since", "24h", "report usage from this long ago (e.g. 168h) or this date (2006-01-02)")
+	by := usageFlags.String("by", "hour", "group usage by hour or day")
+	_ = usageFlags.Parse(args)
+
+	sinceTime, err := parseSince(*since)
+	if err != nil {
+		log.Fatalf("❌ Invalid --since: %v", err)
+	}
+	periods := map[string]time.Duration{"hour": time.Hour, "day": 24 * time.Hour}
+	period, ok := periods[*by]
+	if !ok {
+		log.Fatal("❌ --by must be hour or day")
+	}
+
+	query := d1.UsageQuery{
+		KeyRef: *key,
+		Since:  sinceTime,
+		Period: period,
+	}
+	if err := cli.Usage(cfAPI, query); err != nil {
+		log.Fatalf("❌ Failed to report usage: %v", err)
+	}
+}
+
+// parseArgs parses flags given before, between or after the positional
+// arguments, which the flag package alone stops at, and returns the
+// positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		_ = flags.Parse(args)
+		if flags.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// parseExpiry parses a key expiry given as a duration from now or as a date
+// or RFC 3339 time, returning a Unix time. An empty value means no expiry.
+func parseExpiry(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		if duration <= 0 {
+			return 0, errExpiryInPast
+		}
+		return time.Now().Add(duration).Unix(), nil
+	}
+
+	for _, layout := range []string{time.DateOnly, time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			if !t.After(time.Now()) {
+				return 0, errExpiryInPast
+			}
+			return t.Unix(), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s", errInvalidTime, value)
+}
+
+// parseSince parses the start of a report given as a duration before now or
+// as a date or RFC 3339 time, returning a Unix time.
+func parseSince(value string) (int64, error) {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration).Unix(), nil
+	}
+
+	for _, layout := range []string{time.DateOnly, time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s", errInvalidTime, value)
+}
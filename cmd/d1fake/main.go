@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/robalyx/roscoe/internal/d1fake"
+	_ "modernc.org/sqlite" // register driver
+)
+
+// main serves a local stand-in for the Cloudflare D1 query API backed by
+// SQLite. Point the CLI at it with ROSCOE_CF_API_BASE_URL.
+func main() {
+	addr := flag.String("addr", ":8788", "address to listen on")
+	dbPath := flag.String("db", "d1fake.db", "SQLite database file, or :memory: for an in-memory database")
+	token := flag.String("token", "", "API token clients must send, if any")
+	flag.Parse()
+
+	if err := serve(*addr, *dbPath, *token); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve opens the SQLite database and serves the D1 query API until the server stops.
+func serve(addr, dbPath, token string) error {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+	defer db.Close()
+
+	// An in-memory database only lives as long as its connection
+	db.SetMaxOpenConns(1)
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           d1fake.NewServer(db, token),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("Serving D1 query API on %s (database: %s)", addr, dbPath)
+	return server.ListenAndServe()
+}
@@ -0,0 +1,90 @@
+//go:build !js || !wasm
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	d1Flag "github.com/robalyx/roscoe/internal/service/d1"
+	_ "modernc.org/sqlite" // register driver
+)
+
+// main serves the worker routes over plain HTTP, backed by a local SQLite
+// database in place of the D1 binding. This is meant for local development
+// and CI; deployments use the WebAssembly build.
+func main() {
+	addr := flag.String("addr", ":8787", "address to listen on")
+	dbPath := flag.String("db", "roscoe.db", "SQLite database file, or :memory: for an in-memory database")
+	apiKey := flag.String("api-key", "", "API key to register with the admin scope on startup")
+	flag.Parse()
+
+	if err := serve(*addr, *dbPath, *apiKey); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve opens the SQLite database and serves the worker routes until the server stops.
+func serve(addr, dbPath, apiKey string) error {
+	// Initialize SQLite database
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+	defer db.Close()
+
+	// An in-memory database only lives as long as its connection
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+	if err := d1Flag.InitSchema(ctx, db); err != nil {
+		return fmt.Errorf("failed to initialize schema: %w", err)
+	}
+
+	if apiKey != "" {
+		if err := registerKey(ctx, db, apiKey); err != nil {
+			return err
+		}
+	}
+
+	router, err := newRouter(db, os.Getenv, func(task func()) { go task() })
+	if err != nil {
+		return fmt.Errorf("failed to create router: %w", err)
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("Serving worker routes on %s (database: %s)", addr, dbPath)
+	return server.ListenAndServe()
+}
+
+// registerKey adds the given API key with every scope unless it already exists.
+func registerKey(ctx context.Context, db *sql.DB, key string) error {
+	apiKeyService := d1Flag.NewAPIKeyService(db)
+
+	valid, err := apiKeyService.ValidateKey(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to check API key: %w", err)
+	}
+	if valid {
+		return nil
+	}
+
+	if _, err := apiKeyService.AddKey(ctx, key, d1Flag.KeyOptions{
+		Description: "Local development key",
+		Scopes:      []string{d1Flag.ScopeAdmin},
+	}); err != nil {
+		return fmt.Errorf("failed to register API key: %w", err)
+	}
+	return nil
+}
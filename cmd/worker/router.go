@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robalyx/roscoe/internal/http/handler"
+	d1Flag "github.com/robalyx/roscoe/internal/service/d1"
+)
+
+// version is the server build version reported by the metadata endpoint. It
+// is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+var errInvalidCooldown = errors.New("QUEUE_COOLDOWN must be a non-negative duration such as 168h")
+
+// authWrapper wraps a handler with the middleware that authenticates requests
+// with a key that has the given scope.
+type authWrapper func(scope string, h http.HandlerFunc) http.HandlerFunc
+
+// newRouter creates a new HTTP router with middleware and routes. The getenv
+// function looks up worker configuration such as REQUIRE_AUTH, and background
+// runs a task without delaying the response.
+func newRouter(db *sql.DB, getenv func(string) string, background func(task func())) (http.Handler, error) {
+	cooldown, err := queueCooldown(getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize services
+	flagService := d1Flag.NewFlagService(db)
+	apiKeyService := d1Flag.NewAPIKeyService(db)
+	queueService := d1Flag.NewQueueService(db, flagService, cooldown)
+	metaService := d1Flag.NewMetaService(db)
+	rateLimitService := d1Flag.NewRateLimitService(db)
+	usageRecorder := d1Flag.NewUsageRecorder(db)
+
+	// Initialize the tables owned by the worker
+	tables := []struct {
+		name string
+		init func(context.Context) error
+	}{
+		{"queue", queueService.InitQueueTable},
+		{"metadata", metaService.InitMetaTable},
+		{"rate limit", rateLimitService.InitRateLimitTable},
+		{"usage", usageRecorder.InitUsageTable},
+	}
+	for _, table := range tables {
+		if err := table.init(context.Background()); err != nil {
+			return nil, fmt.Errorf("failed to initialize %s table: %w", table.name, err)
+		}
+	}
+
+	mux := http.NewServeMux()
+
+	// Get auth requirement from environment
+	requireAuth := getenv("REQUIRE_AUTH") != "false"
+
+	// Wrap handlers with auth middleware requiring the given scope, the key's
+	// rate limit and usage tracking, if required
+	var withAuth authWrapper = func(scope string, h http.HandlerFunc) http.HandlerFunc {
+		if !requireAuth {
+			return h
+		}
+		limited := handler.RateLimitMiddleware(rateLimitService)(h)
+		tracked := handler.UsageMiddleware(usageRecorder, background)(limited)
+		return handler.AuthMiddleware(apiKeyService, scope, background)(tracked).ServeHTTP
+	}
+
+	// Routes
+	mux.HandleFunc("/lookup/roblox/user", withAuth(d1Flag.ScopeLookupRead, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			handler.BatchLookup(flagService, rateLimitService)(w, r)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}))
+
+	mux.HandleFunc("/lookup/roblox/user/", withAuth(d1Flag.ScopeLookupRead, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Extract ID from path
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 5 || parts[4] == "" {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+
+		handler.SingleLookup(flagService, rateLimitService)(w, r)
+	}))
+
+	mux.HandleFunc("/meta", withAuth(d1Flag.ScopeLookupRead, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			handler.Meta(metaService, version)(w, r)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}))
+
+	registerQueueRoutes(mux, withAuth, queueService, rateLimitService)
+
+	// Without authentication anyone could manage keys, and the D1 database
+	// may be shared with deployments that require it
+	if requireAuth {
+		registerAdminRoutes(mux, withAuth, apiKeyService)
+	}
+
+	return mux, nil
+}
+
+// queueCooldown returns how long after being queued a user can't be queued
+// again, from the QUEUE_COOLDOWN duration such as "168h" if it is set.
+func queueCooldown(getenv func(string) string) (time.Duration, error) {
+	value := getenv("QUEUE_COOLDOWN")
+	if value == "" {
+		return d1Flag.DefaultQueueCooldown, nil
+	}
+
+	cooldown, err := time.ParseDuration(value)
+	if err != nil || cooldown < 0 {
+		return 0, fmt.Errorf("%w: %q", errInvalidCooldown, value)
+	}
+	return cooldown, nil
+}
+
+// registerQueueRoutes adds the routes for submitting users to the queue and
+// for the consumers that process it.
+func registerQueueRoutes(
+	mux *http.ServeMux, withAuth authWrapper,
+	queueService *d1Flag.QueueService, rateLimitService *d1Flag.RateLimitService,
+) {
+	mux.HandleFunc("/queue/roblox/user", withAuth(d1Flag.ScopeQueueWrite, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			handler.QueueUser(queueService, rateLimitService)(w, r)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}))
+
+	mux.HandleFunc("/queue/roblox/users", withAuth(d1Flag.ScopeQueueWrite, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			handler.QueueUsers(queueService, rateLimitService)(w, r)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}))
+
+	mux.HandleFunc("/queue/roblox/user/", withAuth(d1Flag.ScopeQueueWrite, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			handler.QueueStatus(queueService)(w, r)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}))
+
+	mux.HandleFunc("/queue/roblox/user/status", withAuth(d1Flag.ScopeQueueWrite, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			handler.BatchQueueStatus(queueService)(w, r)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}))
+
+	mux.HandleFunc("/queue/roblox/user/claim", withAuth(d1Flag.ScopeQueueProcess, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			handler.ClaimUsers(queueService)(w, r)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}))
+
+	reportResults := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			handler.ReportResults(queueService)(w, r)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+	mux.HandleFunc("/queue/roblox/user/result", withAuth(d1Flag.ScopeQueueProcess, reportResults))
+}
+
+// registerAdminRoutes adds the routes for managing API keys.
+func registerAdminRoutes(mux *http.ServeMux, withAuth authWrapper, apiKeyService *d1Flag.APIKeyService) {
+	mux.HandleFunc("/admin/keys", withAuth(d1Flag.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handler.ListKeys(apiKeyService)(w, r)
+		case http.MethodPost:
+			handler.CreateKey(apiKeyService)(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	mux.HandleFunc("/admin/keys/", withAuth(d1Flag.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			handler.RemoveKey(apiKeyService)(w, r)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}))
+}
@@ -4,22 +4,31 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/url"
+	"os"
+	"os/signal"
 	"time"
 
 	"github.com/robalyx/roscoe/internal/service/d1"
 	"github.com/robalyx/roscoe/internal/service/database"
 )
 
+// connectSource connects to the database that flags are synced from. Tests
+// replace it to sync from a local database.
+var connectSource = database.NewClient
+
 // RunSync syncs the database with D1.
-func RunSync(dbURL, accountID, d1ID, token string) error {
+func RunSync(dbURL string, cfAPI *d1.CloudflareAPI, opts d1.SyncOptions) error {
 	start := time.Now()
 	log.Printf("🚀 Starting flag update process...")
 
-	ctx := context.Background()
+	// Stop cleanly on Ctrl-C so committed checkpoints can be resumed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
 	// Initialize database client
 	log.Printf("🔌 Connecting to database...")
-	db, err := database.NewClient(ctx, dbURL)
+	db, err := connectSource(ctx, dbURL)
 	if err != nil {
 		return fmt.Errorf("failed to connect to database: %w", err)
 	}
@@ -27,10 +36,11 @@ func RunSync(dbURL, accountID, d1ID, token string) error {
 	log.Printf("✅ Database connection established")
 
 	// Initialize sync service
-	syncService := d1.NewSyncService(db.DB(), accountID, d1ID, token)
+	syncService := d1.NewSyncService(db.DB(), cfAPI)
+	opts.SourceHost = sourceHost(dbURL)
 
 	// Update flags
-	if err := syncService.UpdateFlags(ctx); err != nil {
+	if err := syncService.UpdateFlags(ctx, opts); err != nil {
 		return fmt.Errorf("failed to update flags: %w", err)
 	}
 
@@ -39,69 +49,89 @@ func RunSync(dbURL, accountID, d1ID, token string) error {
 	return nil
 }
 
-// AddAPIKey adds a new API key to D1.
-func AddAPIKey(accountID, d1ID, token, description string) error {
+// sourceHost returns the host of a database URL without any credentials.
+func sourceHost(dbURL string) string {
+	parsed, err := url.Parse(dbURL)
+	if err != nil || parsed.Host == "" {
+		return "unknown"
+	}
+	return parsed.Host
+}
+
+// Migrate upgrades the D1 schema created by older versions. Plaintext API keys
+// too short to hash are only removed if dropShortKeys is set.
+func Migrate(cfAPI *d1.CloudflareAPI, dropShortKeys bool) error {
 	ctx := context.Background()
 
-	key, err := d1.GenerateKey()
-	if err != nil {
-		return fmt.Errorf("failed to generate API key: %w", err)
+	log.Printf("🔧 Migrating D1 schema...")
+	if err := d1.NewMigrationService(cfAPI).Migrate(ctx, dropShortKeys); err != nil {
+		return fmt.Errorf("failed to migrate schema: %w", err)
 	}
 
-	cfAPI := d1.NewCloudflareAPI(accountID, d1ID, token)
+	log.Printf("✅ Schema is up to date")
+	return nil
+}
 
-	sql := `INSERT INTO api_keys (key, description, created_at) VALUES (?, ?, ?)`
-	params := []any{key, description, time.Now().Unix()}
+// ListSnapshots lists the flag snapshots available for rollbacks.
+func ListSnapshots(cfAPI *d1.CloudflareAPI) error {
+	ctx := context.Background()
 
-	if _, err := cfAPI.ExecuteSQL(ctx, sql, params); err != nil {
-		return fmt.Errorf("failed to add API key: %w", err)
+	snapshots, err := d1.NewSnapshotService(cfAPI).ListSnapshots(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	if len(snapshots) == 0 {
+		log.Printf("No snapshots found")
+		return nil
+	}
+
+	log.Printf("📸 Snapshots:")
+	for _, snapshot := range snapshots {
+		timestamp := time.Unix(snapshot.CreatedAt, 0).Format("2006-01-02 15:04:05")
+		log.Printf("• %s - %d flags (%d flagged, %d confirmed, created: %s)",
+			snapshot.Name, snapshot.RowCount, snapshot.FlaggedCount, snapshot.ConfirmedCount, timestamp)
 	}
 
-	log.Printf("✅ Successfully added API key: %s", key)
 	return nil
 }
 
-// RemoveAPIKey removes an API key from D1.
-func RemoveAPIKey(accountID, d1ID, token, key string) error {
+// Rollback swaps a flag snapshot back in. If name is empty, the latest snapshot is used.
+func Rollback(cfAPI *d1.CloudflareAPI, name string) error {
 	ctx := context.Background()
-	cfAPI := d1.NewCloudflareAPI(accountID, d1ID, token)
 
-	sql := `DELETE FROM api_keys WHERE key = ?`
-	params := []any{key}
-
-	if _, err := cfAPI.ExecuteSQL(ctx, sql, params); err != nil {
-		return fmt.Errorf("failed to remove API key: %w", err)
+	snapshot, err := d1.NewSnapshotService(cfAPI).Rollback(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to roll back: %w", err)
 	}
 
-	log.Printf("✅ Successfully removed API key: %s", key)
+	log.Printf("✅ Successfully rolled back to %s (%d flags)", snapshot.Name, snapshot.RowCount)
 	return nil
 }
 
-// ListAPIKeys lists all API keys in D1.
-func ListAPIKeys(accountID, d1ID, token string) error {
+// SyncHistory lists the most recent sync runs.
+func SyncHistory(cfAPI *d1.CloudflareAPI, limit int) error {
 	ctx := context.Background()
-	cfAPI := d1.NewCloudflareAPI(accountID, d1ID, token)
 
-	sql := `SELECT key, description, created_at FROM api_keys ORDER BY created_at DESC`
-
-	results, err := cfAPI.ExecuteSQL(ctx, sql, nil)
+	runs, err := d1.NewSyncHistoryService(cfAPI).ListRuns(ctx, limit)
 	if err != nil {
-		return fmt.Errorf("failed to list API keys: %w", err)
+		return fmt.Errorf("failed to list sync runs: %w", err)
 	}
 
-	if len(results) == 0 {
-		log.Printf("No API keys found")
+	if len(runs) == 0 {
+		log.Printf("No sync runs found")
 		return nil
 	}
 
-	log.Printf("📝 API Keys:")
-	for _, result := range results {
-		key := result["key"].(string)
-		description := result["description"].(string)
-		createdAt := int64(result["created_at"].(float64))
-
-		timestamp := time.Unix(createdAt, 0).Format("2006-01-02 15:04:05")
-		log.Printf("• %s - %s (created: %s)", key, description, timestamp)
+	log.Printf("🕒 Sync History:")
+	for _, run := range runs {
+		timestamp := time.Unix(run.StartedAt, 0).Format("2006-01-02 15:04:05")
+		log.Printf("• #%d %s - %s %s (took %v, %d flags: %d flagged, %d confirmed, %d rows written, host: %s, version: %s)",
+			run.ID, timestamp, run.Mode, run.Outcome, run.Duration(), run.TotalCount, run.FlaggedCount,
+			run.ConfirmedCount, run.RowsWritten, run.SourceHost, run.CLIVersion)
+		if run.Error != "" {
+			log.Printf("  ↳ %s", run.Error)
+		}
 	}
 
 	return nil
@@ -0,0 +1,255 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/robalyx/roscoe/internal/service/d1"
+)
+
+// AddAPIKey adds a new API key to D1. Only its hash is stored, so the key is
+// shown once and can't be recovered later.
+func AddAPIKey(cfAPI *d1.CloudflareAPI, opts d1.KeyOptions) error {
+	ctx := context.Background()
+
+	key, id, err := insertAPIKey(ctx, cfAPI, opts)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("✅ Successfully added API key #%d (prefix %s, scopes: %s, expires: %s, limits: %s): %s",
+		id, d1.KeyPrefix(key), strings.Join(opts.Scopes, ", "),
+		formatTime(opts.ExpiresAt, "never"), formatLimits(opts), key)
+	log.Printf("⚠️ Store this key now, it can't be shown again")
+	return nil
+}
+
+// RotateAPIKey replaces an API key with a new key with the same settings. The
+// old key keeps working for the grace period and then expires.
+func RotateAPIKey(cfAPI *d1.CloudflareAPI, ref string, grace time.Duration) error {
+	ctx := context.Background()
+
+	old, err := resolveAPIKey(ctx, cfAPI, ref)
+	if err != nil {
+		return err
+	}
+	if old.ReplacedBy != 0 {
+		return fmt.Errorf("%w: #%d was replaced by #%d", d1.ErrKeyRotated, old.ID, old.ReplacedBy)
+	}
+
+	key, id, err := insertAPIKey(ctx, cfAPI, old.Options())
+	if err != nil {
+		return err
+	}
+
+	// The old key keeps an earlier expiry, and is only marked once so
+	// concurrent rotations can't both succeed
+	now := time.Now()
+	graceEnd := now.Add(grace).Unix()
+	sql := `
+		UPDATE api_keys SET
+			replaced_by = ?, rotated_at = ?, expires_at = MIN(COALESCE(expires_at, ?), ?)
+		WHERE id = ? AND replaced_by IS NULL
+	`
+	params := []any{id, now.Unix(), graceEnd, graceEnd, old.ID}
+
+	result, err := cfAPI.ExecuteSQL(ctx, sql, params)
+	if err == nil && result.TotalMeta().Changes == 0 {
+		err = fmt.Errorf("%w: #%d", d1.ErrKeyRotated, old.ID)
+	}
+	if err != nil {
+		if _, cleanupErr := cfAPI.ExecuteSQL(ctx, `DELETE FROM api_keys WHERE id = ?`, []any{id}); cleanupErr != nil {
+			log.Printf("⚠️ Failed to remove unused key #%d: %v", id, cleanupErr)
+		}
+		return fmt.Errorf("failed to retire old API key: %w", err)
+	}
+
+	log.Printf("✅ Successfully rotated API key #%d (prefix %s) to #%d (prefix %s): %s",
+		old.ID, old.Prefix, id, d1.KeyPrefix(key), key)
+	if old.ExpiresAt != 0 && old.ExpiresAt < graceEnd {
+		graceEnd = old.ExpiresAt
+	}
+	log.Printf("⏳ The old key keeps working until %s", formatTime(graceEnd, ""))
+	log.Printf("⚠️ Store this key now, it can't be shown again")
+	return nil
+}
+
+// insertAPIKey generates a new API key with the given options, stores its hash
+// and returns the key and its ID.
+func insertAPIKey(ctx context.Context, cfAPI *d1.CloudflareAPI, opts d1.KeyOptions) (string, int64, error) {
+	key, err := d1.GenerateKey()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to generate API key: %w", err)
+	}
+
+	hashed, err := d1.HashKey(key)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to hash API key: %w", err)
+	}
+
+	result, err := cfAPI.ExecuteSQL(ctx, d1.InsertKeySQL, opts.InsertParams(hashed))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to add API key: %w", err)
+	}
+
+	return key, result.TotalMeta().LastRowID, nil
+}
+
+// RemoveAPIKey removes an API key from D1 by its ID, prefix or full key.
+func RemoveAPIKey(cfAPI *d1.CloudflareAPI, ref string) error {
+	ctx := context.Background()
+
+	key, err := resolveAPIKey(ctx, cfAPI, ref)
+	if err != nil {
+		return err
+	}
+
+	sql := `DELETE FROM api_keys WHERE id = ?`
+	params := []any{key.ID}
+
+	if _, err := cfAPI.ExecuteSQL(ctx, sql, params); err != nil {
+		return fmt.Errorf("failed to remove API key: %w", err)
+	}
+
+	log.Printf("✅ Successfully removed API key #%d (prefix %s)", key.ID, key.Prefix)
+	return nil
+}
+
+// SetAPIKeyDisabled disables or re-enables an API key by its ID, prefix or full key.
+func SetAPIKeyDisabled(cfAPI *d1.CloudflareAPI, ref string, disabled bool) error {
+	ctx := context.Background()
+
+	key, err := resolveAPIKey(ctx, cfAPI, ref)
+	if err != nil {
+		return err
+	}
+
+	sql := `UPDATE api_keys SET disabled = ? WHERE id = ?`
+	params := []any{disabled, key.ID}
+
+	if _, err := cfAPI.ExecuteSQL(ctx, sql, params); err != nil {
+		return fmt.Errorf("failed to update API key: %w", err)
+	}
+
+	action := "enabled"
+	if disabled {
+		action = "disabled"
+	}
+	log.Printf("✅ Successfully %s API key #%d (prefix %s)", action, key.ID, key.Prefix)
+	return nil
+}
+
+// ListAPIKeys lists all API keys in D1 with their status and last use.
+func ListAPIKeys(cfAPI *d1.CloudflareAPI) error {
+	ctx := context.Background()
+
+	sql := `SELECT ` + d1.APIKeyFields + ` FROM api_keys ORDER BY created_at DESC, id DESC`
+
+	result, err := cfAPI.ExecuteSQL(ctx, sql, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list API keys: %w", err)
+	}
+
+	rows := result.Rows()
+	if len(rows) == 0 {
+		log.Printf("No API keys found")
+		return nil
+	}
+
+	now := time.Now()
+	log.Printf("📝 API Keys:")
+	for _, row := range rows {
+		key := apiKeyFromRow(row)
+
+		status := key.Status(now)
+		if status == d1.KeyStatusActive && key.ExpiresAt != 0 {
+			status += ", expires " + formatTime(key.ExpiresAt, "")
+		}
+		if key.ReplacedBy != 0 {
+			status += fmt.Sprintf(", replaced by #%d", key.ReplacedBy)
+		}
+
+		log.Printf("• #%d %s… - %s [%s] %s (limits: %s, created: %s, last used: %s)",
+			key.ID, key.Prefix, key.Description, strings.Join(key.Scopes, ", "), status,
+			formatLimits(key.Options()),
+			formatTime(key.CreatedAt, ""), formatTime(key.LastUsedAt, "never"))
+	}
+
+	return nil
+}
+
+// resolveAPIKey returns the only API key matching an ID, prefix or full key.
+func resolveAPIKey(ctx context.Context, cfAPI *d1.CloudflareAPI, ref string) (*d1.APIKey, error) {
+	sql := `SELECT ` + d1.APIKeyFields + ` FROM api_keys WHERE ` + d1.KeyRefCondition
+
+	result, err := cfAPI.ExecuteSQL(ctx, sql, d1.KeyRefParams(ref))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up API key: %w", err)
+	}
+
+	rows := result.Rows()
+	switch len(rows) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", d1.ErrKeyNotFound, ref)
+	case 1:
+		return apiKeyFromRow(rows[0]), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", d1.ErrAmbiguousKey, ref)
+	}
+}
+
+// apiKeyFromRow converts an api_keys row returned by the D1 API to an APIKey.
+func apiKeyFromRow(row map[string]any) *d1.APIKey {
+	key := &d1.APIKey{
+		ID:        int64(row["id"].(float64)),
+		Prefix:    row["prefix"].(string),
+		Scopes:    strings.Fields(row["scopes"].(string)),
+		Disabled:  row["disabled"].(float64) != 0,
+		CreatedAt: int64(row["created_at"].(float64)),
+	}
+	key.Description, _ = row["description"].(string)
+	key.ExpiresAt = optionalInt(row["expires_at"])
+	key.LastUsedAt = optionalInt(row["last_used_at"])
+	key.RequestsPerMinute = optionalInt(row["requests_per_minute"])
+	key.DailyIDQuota = optionalInt(row["daily_id_quota"])
+	key.DailyQueueQuota = optionalInt(row["daily_queue_quota"])
+	key.ReplacedBy = optionalInt(row["replaced_by"])
+	key.RotatedAt = optionalInt(row["rotated_at"])
+	return key
+}
+
+// optionalInt returns a nullable integer column returned by the D1 API, or zero if it is NULL.
+func optionalInt(value any) int64 {
+	number, _ := value.(float64)
+	return int64(number)
+}
+
+// formatLimits formats a key's rate limits for display.
+func formatLimits(opts d1.KeyOptions) string {
+	var limits []string
+	if opts.RequestsPerMinute != 0 {
+		limits = append(limits, fmt.Sprintf("%d requests/min", opts.RequestsPerMinute))
+	}
+	if opts.DailyIDQuota != 0 {
+		limits = append(limits, fmt.Sprintf("%d IDs/day", opts.DailyIDQuota))
+	}
+	if opts.DailyQueueQuota != 0 {
+		limits = append(limits, fmt.Sprintf("%d queued users/day", opts.DailyQueueQuota))
+	}
+
+	if len(limits) == 0 {
+		return "none"
+	}
+	return strings.Join(limits, ", ")
+}
+
+// formatTime formats a Unix time for display, or returns zero if it is zero.
+func formatTime(unix int64, zero string) string {
+	if unix == 0 {
+		return zero
+	}
+	return time.Unix(unix, 0).Format("2006-01-02 15:04:05")
+}
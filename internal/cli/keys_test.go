@@ -0,0 +1,171 @@
+//go:build !js || !wasm
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robalyx/roscoe/internal/d1fake"
+	"github.com/robalyx/roscoe/internal/service/d1"
+
+	_ "modernc.org/sqlite"
+)
+
+// addedKeyPattern matches the key printed by AddAPIKey and RotateAPIKey.
+var addedKeyPattern = regexp.MustCompile(`#(\d+) \(prefix [^)]*\): ([A-Za-z0-9_-]{43})\n`)
+
+// newTestD1 starts a fake D1 API backed by an in-memory database with the
+// current schema, returning a client for it and the database to inspect.
+func newTestD1(t *testing.T) (*d1.CloudflareAPI, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	server := httptest.NewServer(d1fake.NewServer(db, "token"))
+	t.Cleanup(server.Close)
+
+	cfAPI := d1.NewCloudflareAPI("account", "database", "token",
+		d1.WithBaseURL(server.URL), d1.WithRetryPolicy(d1.RetryPolicy{MaxAttempts: 1}))
+	if err := Migrate(cfAPI, false); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	return cfAPI, db
+}
+
+// captureLog returns the log output written while fn runs.
+func captureLog(t *testing.T, fn func() error) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	if err := fn(); err != nil {
+		t.Fatalf("command failed: %v\n%s", err, buf.String())
+	}
+	return buf.String()
+}
+
+// addKey adds an API key and returns the key printed for it.
+func addKey(t *testing.T, cfAPI *d1.CloudflareAPI, opts d1.KeyOptions) string {
+	t.Helper()
+
+	output := captureLog(t, func() error { return AddAPIKey(cfAPI, opts) })
+	match := addedKeyPattern.FindStringSubmatch(output)
+	if match == nil {
+		t.Fatalf("no key in output:\n%s", output)
+	}
+	return match[2]
+}
+
+func TestAddAndListAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	cfAPI, db := newTestD1(t)
+
+	key := addKey(t, cfAPI, d1.KeyOptions{
+		Description:     "bot",
+		Scopes:          []string{d1.ScopeLookupRead, d1.ScopeQueueWrite},
+		DailyQueueQuota: 25,
+	})
+	adminKey := addKey(t, cfAPI, d1.KeyOptions{
+		Description: "admin",
+		Scopes:      []string{d1.ScopeAdmin},
+		ExpiresAt:   time.Now().Add(time.Hour).Unix(),
+	})
+
+	// Only the prefix and a salted hash of each key are stored
+	var prefix, hash, scopes string
+	var quota int64
+	var rpm sql.NullInt64
+	err := db.QueryRow(`
+		SELECT prefix, key_hash, scopes, daily_queue_quota, requests_per_minute
+		FROM api_keys WHERE description = 'bot'
+	`).Scan(&prefix, &hash, &scopes, &quota, &rpm)
+	if err != nil {
+		t.Fatalf("failed to read api_keys: %v", err)
+	}
+	if prefix != d1.KeyPrefix(key) {
+		t.Errorf("prefix = %q, want %q", prefix, d1.KeyPrefix(key))
+	}
+	if hash == "" || strings.Contains(hash, key) {
+		t.Errorf("key_hash = %q, want a hash of the key", hash)
+	}
+	if scopes != d1.FormatScopes([]string{d1.ScopeLookupRead, d1.ScopeQueueWrite}) {
+		t.Errorf("scopes = %q", scopes)
+	}
+	if quota != 25 || rpm.Valid {
+		t.Errorf("limits = %d queued per day, %v per minute, want 25 and no limit", quota, rpm)
+	}
+
+	// The stored keys authenticate as the worker would
+	record, err := d1.NewAPIKeyService(db).Authenticate(ctx, adminKey)
+	if err != nil {
+		t.Fatalf("failed to authenticate admin key: %v", err)
+	}
+	if record.Description != "admin" || !record.HasScope(d1.ScopeAdmin) {
+		t.Errorf("admin key authenticated as %q with scopes %v", record.Description, record.Scopes)
+	}
+
+	output := captureLog(t, func() error { return ListAPIKeys(cfAPI) })
+	for _, want := range []string{
+		"#1 " + d1.KeyPrefix(key) + "… - bot [lookup:read, queue:write] active (limits: 25 queued users/day",
+		"#2 " + d1.KeyPrefix(adminKey) + "… - admin [admin] active, expires ",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("list output is missing %q:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, key) || strings.Contains(output, adminKey) {
+		t.Errorf("list output contains a full key:\n%s", output)
+	}
+}
+
+func TestRotateAPIKey(t *testing.T) {
+	cfAPI, db := newTestD1(t)
+
+	addKey(t, cfAPI, d1.KeyOptions{Description: "bot", Scopes: []string{d1.ScopeLookupRead}, DailyIDQuota: 500})
+
+	output := captureLog(t, func() error { return RotateAPIKey(cfAPI, "1", time.Hour) })
+	if match := addedKeyPattern.FindStringSubmatch(output); match == nil || match[1] != "2" {
+		t.Fatalf("rotation didn't print new key #2:\n%s", output)
+	}
+
+	var replacedBy, expiresAt int64
+	err := db.QueryRow(`SELECT replaced_by, expires_at FROM api_keys WHERE id = 1`).Scan(&replacedBy, &expiresAt)
+	if err != nil {
+		t.Fatalf("failed to read old key: %v", err)
+	}
+	if replacedBy != 2 {
+		t.Errorf("replaced_by = %d, want 2", replacedBy)
+	}
+	if graceEnd := time.Now().Add(time.Hour).Unix(); expiresAt < graceEnd-60 || expiresAt > graceEnd {
+		t.Errorf("old key expires at %d, want about %d", expiresAt, graceEnd)
+	}
+
+	var description string
+	var quota int64
+	err = db.QueryRow(`SELECT description, daily_id_quota FROM api_keys WHERE id = 2`).Scan(&description, &quota)
+	if err != nil {
+		t.Fatalf("failed to read new key: %v", err)
+	}
+	if description != "bot" || quota != 500 {
+		t.Errorf("new key = %q with %d IDs per day, want the settings of the old key", description, quota)
+	}
+
+	if err := RotateAPIKey(cfAPI, "1", time.Hour); err == nil {
+		t.Error("rotating a replaced key succeeded, want an error")
+	}
+}
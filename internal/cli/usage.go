@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/robalyx/roscoe/internal/service/d1"
+)
+
+// Usage prints API key usage grouped into periods, followed by totals per key.
+func Usage(cfAPI *d1.CloudflareAPI, query d1.UsageQuery) error {
+	ctx := context.Background()
+
+	rows, err := d1.NewUsageService(cfAPI).Report(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to read usage: %w", err)
+	}
+
+	log.Printf("📊 API key usage since %s:", formatTime(query.Since, ""))
+	if len(rows) == 0 {
+		log.Printf("No usage recorded")
+		return nil
+	}
+
+	var keyIDs []int64
+	totals := make(map[int64]*d1.UsageRow)
+	var period int64
+	for _, row := range rows {
+		if row.PeriodStart != period {
+			period = row.PeriodStart
+			log.Printf("%s", time.Unix(period, 0).Format("2006-01-02 15:04"))
+		}
+		log.Printf("  • %s %s: %s", formatUsageKey(&row), row.Route, formatUsageCounts(row.UsageCounts))
+
+		total, ok := totals[row.KeyID]
+		if !ok {
+			total = &d1.UsageRow{KeyID: row.KeyID, Prefix: row.Prefix, Description: row.Description}
+			totals[row.KeyID] = total
+			keyIDs = append(keyIDs, row.KeyID)
+		}
+		total.Requests += row.Requests
+		total.IDs += row.IDs
+		total.Flagged += row.Flagged
+		total.Errors += row.Errors
+	}
+
+	log.Printf("Totals:")
+	for _, keyID := range keyIDs {
+		total := totals[keyID]
+		log.Printf("  • %s: %s", formatUsageKey(total), formatUsageCounts(total.UsageCounts))
+	}
+
+	return nil
+}
+
+// formatUsageKey formats the key of a usage row for display.
+func formatUsageKey(row *d1.UsageRow) string {
+	if row.Prefix == "" {
+		return fmt.Sprintf("#%d (removed)", row.KeyID)
+	}
+	return fmt.Sprintf("#%d %s… (%s)", row.KeyID, row.Prefix, row.Description)
+}
+
+// formatUsageCounts formats usage counters for display.
+func formatUsageCounts(counts d1.UsageCounts) string {
+	return fmt.Sprintf("%d requests, %d IDs, %d flagged, %d errors",
+		counts.Requests, counts.IDs, counts.Flagged, counts.Errors)
+}
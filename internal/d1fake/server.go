@@ -0,0 +1,248 @@
+// Package d1fake implements a local stand-in for the Cloudflare D1 HTTP query
+// API on top of a database/sql connection, so the CLI can run without Cloudflare.
+package d1fake
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robalyx/roscoe/internal/service/d1"
+)
+
+// Cloudflare error codes returned by the server.
+const (
+	codeAuthentication = 10000
+	codeInvalidRequest = 7400
+	codeSQLError       = 7500
+)
+
+var (
+	ErrParamCount = errors.New("wrong number of parameters")
+	ErrNoSQL      = errors.New("no SQL statements given")
+)
+
+// queryRequest is the request body of the query endpoint.
+type queryRequest struct {
+	SQL    string `json:"sql"`
+	Params []any  `json:"params"`
+}
+
+// Server serves the D1 query endpoint:
+//
+//	POST .../accounts/{account_id}/d1/database/{database_id}/query
+//
+// All statements of a request run in a single transaction, like on D1.
+type Server struct {
+	db    *sql.DB
+	token string
+}
+
+// NewServer creates a new fake D1 server. If token is not empty, requests
+// must send it as a bearer token.
+func NewServer(db *sql.DB, token string) *Server {
+	return &Server{
+		db:    db,
+		token: token,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/query") ||
+		!strings.Contains(r.URL.Path, "/d1/database/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if s.token != "" && r.Header.Get("Authorization") != "Bearer "+s.token {
+		sendError(w, http.StatusUnauthorized, codeAuthentication, "Authentication error")
+		return
+	}
+
+	var req queryRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request body: "+err.Error())
+		return
+	}
+
+	results, err := s.execute(r.Context(), req.SQL, req.Params)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, codeSQLError, err.Error())
+		return
+	}
+
+	sendJSON(w, http.StatusOK, d1.Response{
+		Success:  true,
+		Errors:   []d1.ResponseInfo{},
+		Messages: []d1.ResponseInfo{},
+		Result:   results,
+	})
+}
+
+// execute runs every statement in query inside a transaction. Parameters are
+// bound to the statements in order.
+func (s *Server) execute(ctx context.Context, query string, params []any) ([]d1.StatementResult, error) {
+	statements := splitStatements(query)
+	if len(statements) == 0 {
+		return nil, ErrNoSQL
+	}
+
+	args := make([]any, len(params))
+	for i, param := range params {
+		args[i] = convertParam(param)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	results := make([]d1.StatementResult, 0, len(statements))
+	for _, stmt := range statements {
+		if stmt.params > len(args) {
+			return nil, fmt.Errorf("%w: statement needs %d, %d left", ErrParamCount, stmt.params, len(args))
+		}
+		stmtArgs := args[:stmt.params]
+		args = args[stmt.params:]
+
+		result, err := executeStatement(ctx, tx, stmt.sql, stmtArgs)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, *result)
+	}
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%w: %d unused", ErrParamCount, len(args))
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return results, nil
+}
+
+// executeStatement runs a single statement and collects its rows and metadata.
+func executeStatement(ctx context.Context, tx *sql.Tx, query string, args []any) (*d1.StatementResult, error) {
+	start := time.Now()
+	result := &d1.StatementResult{
+		Results: []map[string]any{},
+		Success: true,
+	}
+
+	if returnsRows(query) {
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		if result.Results, err = scanRows(rows); err != nil {
+			return nil, err
+		}
+		result.Meta.RowsRead = int64(len(result.Results))
+		if !isReadOnly(query) {
+			result.Meta.Changes = int64(len(result.Results))
+		}
+	} else {
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		result.Meta.Changes, _ = res.RowsAffected()
+		result.Meta.LastRowID, _ = res.LastInsertId()
+	}
+
+	result.Meta.RowsWritten = result.Meta.Changes
+	result.Meta.ChangedDB = !isReadOnly(query)
+	result.Meta.Duration = float64(time.Since(start).Microseconds()) / 1000
+	return result, nil
+}
+
+// scanRows reads all rows into maps keyed by column name.
+func scanRows(rows *sql.Rows) ([]map[string]any, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []map[string]any{}
+	for rows.Next() {
+		values := make([]any, len(columns))
+		ptrs := make([]any, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]any, len(columns))
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[column] = values[i]
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+// convertParam converts a JSON parameter to a value SQLite can bind, keeping
+// integers exact.
+func convertParam(param any) any {
+	number, ok := param.(json.Number)
+	if !ok {
+		return param
+	}
+	if i, err := number.Int64(); err == nil {
+		return i
+	}
+	if f, err := number.Float64(); err == nil {
+		return f
+	}
+	return number.String()
+}
+
+// returnsRows reports whether a statement produces rows.
+func returnsRows(query string) bool {
+	upper := strings.ToUpper(query)
+	return isReadOnly(query) || strings.Contains(upper, "RETURNING")
+}
+
+// isReadOnly reports whether a statement only reads data.
+func isReadOnly(query string) bool {
+	upper := strings.ToUpper(query)
+	return strings.HasPrefix(upper, "SELECT") || strings.HasPrefix(upper, "PRAGMA") ||
+		strings.HasPrefix(upper, "WITH") || strings.HasPrefix(upper, "EXPLAIN")
+}
+
+// sendError sends an unsuccessful D1 response.
+func sendError(w http.ResponseWriter, status, code int, message string) {
+	sendJSON(w, status, d1.Response{
+		Success:  false,
+		Errors:   []d1.ResponseInfo{{Code: code, Message: message}},
+		Messages: []d1.ResponseInfo{},
+		Result:   []d1.StatementResult{},
+	})
+}
+
+// sendJSON sends a JSON response with the given status code.
+func sendJSON(w http.ResponseWriter, status int, resp d1.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package d1fake
+
+import (
+	"strings"
+)
+
+// statement is a single SQL statement and the number of "?" parameters it uses.
+type statement struct {
+	sql    string
+	params int
+}
+
+// splitStatements splits query into statements on semicolons, ignoring those
+// inside string literals, quoted identifiers, comments and trigger bodies.
+// Comments are removed from the returned statements.
+func splitStatements(query string) []statement {
+	var statements []statement
+	var current strings.Builder
+	params := 0
+
+	flush := func(force bool) {
+		text := strings.TrimSpace(current.String())
+		if text == "" {
+			current.Reset()
+			params = 0
+			return
+		}
+
+		// Semicolons inside a trigger body don't end the statement
+		upper := strings.ToUpper(strings.Join(strings.Fields(text), " "))
+		isTrigger := strings.HasPrefix(upper, "CREATE TRIGGER") || strings.HasPrefix(upper, "CREATE TEMP TRIGGER")
+		if !force && isTrigger && !strings.HasSuffix(upper, "END") {
+			current.WriteByte(';')
+			return
+		}
+
+		statements = append(statements, statement{sql: text, params: params})
+		current.Reset()
+		params = 0
+	}
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			// Copy quoted text up to the closing quote, where doubled quotes are escapes
+			end := i + 1
+			for end < len(query) {
+				if query[end] == c {
+					if end+1 < len(query) && query[end+1] == c {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			end = min(end, len(query)-1)
+			current.WriteString(query[i : end+1])
+			i = end
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			// Skip line comment
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			current.WriteByte('\n')
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			// Skip block comment
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+			current.WriteByte(' ')
+		case c == '?':
+			params++
+			current.WriteByte(c)
+		case c == ';':
+			flush(false)
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush(true)
+
+	return statements
+}
@@ -0,0 +1,56 @@
+package d1fake
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []statement
+	}{
+		{"single", "SELECT 1", []statement{{"SELECT 1", 0}}},
+		{"trailing semicolon", "SELECT ?;", []statement{{"SELECT ?", 1}}},
+		{"empty", " ; ;\n", nil},
+		{
+			"multiple with params",
+			"DELETE FROM t WHERE id = ?; INSERT INTO t VALUES (?, ?)",
+			[]statement{{"DELETE FROM t WHERE id = ?", 1}, {"INSERT INTO t VALUES (?, ?)", 2}},
+		},
+		{
+			"semicolon and question mark in string",
+			"INSERT INTO t VALUES ('a;b?', ?); SELECT 1",
+			[]statement{{"INSERT INTO t VALUES ('a;b?', ?)", 1}, {"SELECT 1", 0}},
+		},
+		{
+			"escaped quote in string",
+			"SELECT 'it''s; fine'; SELECT 2",
+			[]statement{{"SELECT 'it''s; fine'", 0}, {"SELECT 2", 0}},
+		},
+		{"quoted identifier", `SELECT "a;b" FROM t`, []statement{{`SELECT "a;b" FROM t`, 0}}},
+		{
+			"comments removed",
+			"-- drop it; ?\nDROP TABLE t; /* keep; ? */ SELECT 1",
+			[]statement{{"DROP TABLE t", 0}, {"SELECT 1", 0}},
+		},
+		{
+			"trigger body",
+			"CREATE TRIGGER x AFTER INSERT ON t BEGIN UPDATE s SET v = v + 1; DELETE FROM u; END; SELECT 1",
+			[]statement{
+				{"CREATE TRIGGER x AFTER INSERT ON t BEGIN UPDATE s SET v = v + 1; DELETE FROM u; END", 0},
+				{"SELECT 1", 0},
+			},
+		},
+		{"unterminated string", "SELECT 'abc", []statement{{"SELECT 'abc", 0}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitStatements(tt.query); !slices.Equal(got, tt.want) {
+				t.Errorf("splitStatements(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
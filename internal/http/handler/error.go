@@ -13,8 +13,12 @@ const (
 
 var (
 	ErrUnauthorized = &ErrorResponse{Message: "Unauthorized"}
+	ErrKeyExpired   = &ErrorResponse{Message: "Unauthorized: API key has expired"}
+	ErrKeyDisabled  = &ErrorResponse{Message: "Unauthorized: API key is disabled"}
 	ErrInternal     = &ErrorResponse{Message: "Internal Server Error"}
 	ErrBadGateway   = &ErrorResponse{Message: "Bad Gateway"}
+
+	ErrConflictingCredentials = &ErrorResponse{Message: "Bad Request: X-Auth-Token and Authorization contain different keys"}
 )
 
 // ErrorResponse represents an error message structure.
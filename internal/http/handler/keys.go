@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robalyx/roscoe/internal/service/d1"
+)
+
+// createKeyRequest represents the request body for creating an API key. Zero
+// values mean the default scopes, no expiry and no limits.
+type createKeyRequest struct {
+	Description       string   `json:"description"`
+	Scopes            []string `json:"scopes"`
+	ExpiresAt         int64    `json:"expiresAt"`
+	RequestsPerMinute int64    `json:"requestsPerMinute"`
+	DailyIDQuota      int64    `json:"dailyIdQuota"`
+	DailyQueueQuota   int64    `json:"dailyQueueQuota"`
+}
+
+// APIKeyResponse represents the response data for an API key. The key itself
+// is never included, except once when it is created.
+type APIKeyResponse struct {
+	ID                int64    `json:"id"`
+	Key               string   `json:"key,omitempty"`
+	Prefix            string   `json:"prefix"`
+	Description       string   `json:"description"`
+	Scopes            []string `json:"scopes"`
+	Status            string   `json:"status"`
+	ExpiresAt         *int64   `json:"expiresAt"`
+	LastUsedAt        *int64   `json:"lastUsedAt"`
+	RequestsPerMinute *int64   `json:"requestsPerMinute"`
+	DailyIDQuota      *int64   `json:"dailyIdQuota"`
+	DailyQueueQuota   *int64   `json:"dailyQueueQuota"`
+	ReplacedBy        *int64   `json:"replacedBy,omitempty"`
+	CreatedAt         int64    `json:"createdAt"`
+}
+
+// CreateKey handles requests to create an API key. The key is generated by
+// the server and only returned in this response.
+func CreateKey(apiKeyService *d1.APIKeyService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req createKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorMsg := "Invalid request body"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		opts, errorMsg := req.options()
+		if errorMsg != "" {
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		key, err := d1.GenerateKey()
+		if err != nil {
+			sendKeyError(w, "Failed to generate API key", err)
+			return
+		}
+
+		id, err := apiKeyService.AddKey(r.Context(), key, opts)
+		if err != nil {
+			sendKeyError(w, "Failed to create API key", err)
+			return
+		}
+
+		now := time.Now()
+		response := newAPIKeyResponse(&d1.APIKey{
+			ID:                id,
+			Prefix:            d1.KeyPrefix(key),
+			Description:       opts.Description,
+			Scopes:            opts.Scopes,
+			ExpiresAt:         opts.ExpiresAt,
+			RequestsPerMinute: opts.RequestsPerMinute,
+			DailyIDQuota:      opts.DailyIDQuota,
+			DailyQueueQuota:   opts.DailyQueueQuota,
+			CreatedAt:         now.Unix(),
+		}, now)
+		response.Key = key
+
+		SendJSONResponse(w, APIResponse{
+			Success: true,
+			Data:    response,
+		}, http.StatusCreated)
+	}
+}
+
+// ListKeys handles requests to list all API keys.
+func ListKeys(apiKeyService *d1.APIKeyService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := apiKeyService.ListKeys(r.Context())
+		if err != nil {
+			sendKeyError(w, "Failed to list API keys", err)
+			return
+		}
+
+		now := time.Now()
+		data := make([]APIKeyResponse, 0, len(keys))
+		for i := range keys {
+			data = append(data, newAPIKeyResponse(&keys[i], now))
+		}
+
+		SendJSONResponse(w, APIResponse{
+			Success: true,
+			Data:    data,
+		}, http.StatusOK)
+	}
+}
+
+// RemoveKey handles requests to remove an API key by its ID or prefix.
+func RemoveKey(apiKeyService *d1.APIKeyService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract key reference from path
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 4 || parts[3] == "" {
+			errorMsg := "Invalid path"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+		ref := parts[3]
+
+		err := apiKeyService.RemoveKey(r.Context(), ref)
+		if err != nil {
+			statusCode := http.StatusInternalServerError
+			errorMsg := "Failed to remove API key"
+
+			if errors.Is(err, d1.ErrKeyNotFound) {
+				statusCode = http.StatusNotFound
+				errorMsg = "API key not found"
+			} else if errors.Is(err, d1.ErrAmbiguousKey) {
+				statusCode = http.StatusConflict
+				errorMsg = "More than one API key matches, use the key ID instead"
+			} else {
+				log.Printf("Failed to remove API key %s: %v", ref, err)
+			}
+
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, statusCode)
+			return
+		}
+
+		SendJSONResponse(w, APIResponse{
+			Success: true,
+			Data:    map[string]string{"removed": ref},
+		}, http.StatusOK)
+	}
+}
+
+// options validates the request and returns the settings of the new key, or
+// a message describing why the request is invalid.
+func (req *createKeyRequest) options() (d1.KeyOptions, string) {
+	if strings.TrimSpace(req.Description) == "" {
+		return d1.KeyOptions{}, "Invalid description: must not be empty"
+	}
+	if req.RequestsPerMinute < 0 || req.DailyIDQuota < 0 || req.DailyQueueQuota < 0 {
+		return d1.KeyOptions{}, "Invalid limits: must not be negative"
+	}
+	if req.ExpiresAt != 0 && req.ExpiresAt <= time.Now().Unix() {
+		return d1.KeyOptions{}, "Invalid expiresAt: must be in the future"
+	}
+
+	scopes := d1.DefaultScopes
+	if req.Scopes != nil {
+		var err error
+		if scopes, err = d1.ParseScopes(strings.Join(req.Scopes, " ")); err != nil {
+			return d1.KeyOptions{}, "Invalid scopes: " + err.Error()
+		}
+		if len(scopes) == 0 {
+			return d1.KeyOptions{}, "Invalid scopes: at least one scope is required"
+		}
+	}
+
+	return d1.KeyOptions{
+		Description:       req.Description,
+		Scopes:            scopes,
+		ExpiresAt:         req.ExpiresAt,
+		RequestsPerMinute: req.RequestsPerMinute,
+		DailyIDQuota:      req.DailyIDQuota,
+		DailyQueueQuota:   req.DailyQueueQuota,
+	}, ""
+}
+
+// sendKeyError logs an API key management error and sends an internal server
+// error response with the given message.
+func sendKeyError(w http.ResponseWriter, errorMsg string, err error) {
+	log.Printf("%s: %v", errorMsg, err)
+	SendJSONResponse(w, APIResponse{
+		Success: false,
+		Error:   &errorMsg,
+	}, http.StatusInternalServerError)
+}
+
+// newAPIKeyResponse converts an API key record to its response form.
+func newAPIKeyResponse(key *d1.APIKey, now time.Time) APIKeyResponse {
+	return APIKeyResponse{
+		ID:                key.ID,
+		Prefix:            key.Prefix,
+		Description:       key.Description,
+		Scopes:            key.Scopes,
+		Status:            key.Status(now),
+		ExpiresAt:         nilIfZero(key.ExpiresAt),
+		LastUsedAt:        nilIfZero(key.LastUsedAt),
+		RequestsPerMinute: nilIfZero(key.RequestsPerMinute),
+		DailyIDQuota:      nilIfZero(key.DailyIDQuota),
+		DailyQueueQuota:   nilIfZero(key.DailyQueueQuota),
+		ReplacedBy:        nilIfZero(key.ReplacedBy),
+		CreatedAt:         key.CreatedAt,
+	}
+}
+
+// nilIfZero returns a pointer to value, or nil if it is zero.
+func nilIfZero(value int64) *int64 {
+	if value == 0 {
+		return nil
+	}
+	return &value
+}
@@ -39,7 +39,7 @@ type APIResponse struct {
 }
 
 // BatchLookup handles batch flag lookup requests.
-func BatchLookup(flagService *d1.FlagService) http.HandlerFunc {
+func BatchLookup(flagService *d1.FlagService, rateLimitService *d1.RateLimitService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req lookupRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -71,6 +71,11 @@ func BatchLookup(flagService *d1.FlagService) http.HandlerFunc {
 			return
 		}
 
+		// Take the IDs from the key's daily quota
+		if !consumeIDQuota(w, r, rateLimitService, len(req.IDs)) {
+			return
+		}
+
 		// Get the flags for the IDs
 		flags, err := flagService.GetUserFlags(r.Context(), req.IDs)
 		if err != nil {
@@ -82,6 +87,8 @@ func BatchLookup(flagService *d1.FlagService) http.HandlerFunc {
 			return
 		}
 
+		recordLookup(r.Context(), len(req.IDs), len(flags))
+
 		// Convert to response format
 		data := make([]UserFlagResponse, 0, len(req.IDs))
 		for _, id := range req.IDs {
@@ -119,7 +126,7 @@ func BatchLookup(flagService *d1.FlagService) http.HandlerFunc {
 }
 
 // SingleLookup handles single flag lookup requests.
-func SingleLookup(flagService *d1.FlagService) http.HandlerFunc {
+func SingleLookup(flagService *d1.FlagService, rateLimitService *d1.RateLimitService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract ID from path
 		parts := strings.Split(r.URL.Path, "/")
@@ -151,6 +158,10 @@ func SingleLookup(flagService *d1.FlagService) http.HandlerFunc {
 			return
 		}
 
+		if !consumeIDQuota(w, r, rateLimitService, 1) {
+			return
+		}
+
 		flags, err := flagService.GetUserFlags(r.Context(), []uint64{id})
 		if err != nil {
 			errorMsg := "Internal server error"
@@ -161,6 +172,8 @@ func SingleLookup(flagService *d1.FlagService) http.HandlerFunc {
 			return
 		}
 
+		recordLookup(r.Context(), 1, len(flags))
+
 		// Create response based on whether user is flagged
 		var response UserFlagResponse
 		if flagData, exists := flags[id]; exists {
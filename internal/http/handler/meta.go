@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/robalyx/roscoe/internal/service/d1"
+)
+
+// MetaResponse represents the response data for a dataset metadata lookup.
+type MetaResponse struct {
+	DatasetVersion int64  `json:"datasetVersion"`
+	LastSyncedAt   *int64 `json:"lastSyncedAt"`
+	FlaggedCount   int64  `json:"flaggedCount"`
+	ConfirmedCount int64  `json:"confirmedCount"`
+	TotalCount     int64  `json:"totalCount"`
+	ServerVersion  string `json:"serverVersion"`
+}
+
+// Meta handles requests for the freshness and size of the flag dataset.
+func Meta(metaService *d1.MetaService, serverVersion string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		meta, err := metaService.GetDatasetMeta(r.Context())
+		if err != nil {
+			errorMsg := "Internal server error"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusInternalServerError)
+			return
+		}
+
+		response := MetaResponse{
+			DatasetVersion: meta.Version,
+			FlaggedCount:   meta.FlaggedCount,
+			ConfirmedCount: meta.ConfirmedCount,
+			TotalCount:     meta.FlaggedCount + meta.ConfirmedCount,
+			ServerVersion:  serverVersion,
+		}
+		if meta.SyncedAt.Valid {
+			response.LastSyncedAt = &meta.SyncedAt.Int64
+		}
+
+		SendJSONResponse(w, APIResponse{
+			Success: true,
+			Data:    response,
+		}, http.StatusOK)
+	}
+}
@@ -1,34 +1,126 @@
-//go:build js && wasm
-
 package handler
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/robalyx/roscoe/internal/service/d1"
 )
 
-// AuthHeaderName is the header name for the API key.
+// AuthHeaderName is the header name for the API key. The key can also be sent
+// as a bearer token in the Authorization header.
 const AuthHeaderName = "X-Auth-Token"
 
-// AuthMiddleware checks the auth token against valid API keys in D1.
-func AuthMiddleware(apiKeyService *d1.APIKeyService) func(http.Handler) http.Handler {
+// authChallenge is the WWW-Authenticate challenge sent with 401 responses.
+const authChallenge = `Bearer realm="roscoe"`
+
+// errCredentialMismatch is returned when a request sends different keys
+// in the two auth headers.
+var errCredentialMismatch = errors.New("X-Auth-Token and bearer token differ")
+
+// AuthMiddleware checks the auth token against valid API keys in D1 and
+// requires the key to have the given scope. The key's last use is recorded by
+// background, without delaying the response.
+func AuthMiddleware(
+	apiKeyService *d1.APIKeyService, scope string, background func(task func()),
+) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			providedToken := r.Header.Get(AuthHeaderName)
-
-			valid, err := apiKeyService.ValidateKey(r.Context(), providedToken)
+			providedToken, err := requestCredentials(r)
 			if err != nil {
+				w.Header().Set("WWW-Authenticate", authChallenge+`, error="invalid_request"`)
+				SendJSONError(w, ErrConflictingCredentials, http.StatusBadRequest)
+				return
+			}
+
+			key, err := apiKeyService.Authenticate(r.Context(), providedToken)
+			switch {
+			case errors.Is(err, d1.ErrInvalidKey):
+				sendUnauthorized(w, providedToken, err)
+				return
+			case err != nil:
 				SendJSONError(w, ErrInternal, http.StatusInternalServerError)
 				return
 			}
 
-			if !valid {
-				SendJSONError(w, ErrUnauthorized, http.StatusUnauthorized)
+			// The handler keeps using key, so the last use is recorded on a copy
+			touched := *key
+			background(func() {
+				if err := apiKeyService.TouchKey(context.Background(), &touched); err != nil {
+					log.Printf("Failed to record use of API key %d: %v", touched.ID, err)
+				}
+			})
+
+			// Keys replaced by a rotation keep working until their grace
+			// period ends, so clients are told to switch to the new key
+			if key.ReplacedBy != 0 {
+				w.Header().Set("Deprecation", fmt.Sprintf("@%d", key.RotatedAt))
+				if key.ExpiresAt != 0 {
+					w.Header().Set("Sunset", time.Unix(key.ExpiresAt, 0).UTC().Format(http.TimeFormat))
+				}
+			}
+
+			if !key.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`%s, error="insufficient_scope", scope=%q`, authChallenge, scope))
+				SendJSONError(w, &ErrorResponse{
+					Message: fmt.Sprintf("Forbidden: API key is missing the %q scope", scope),
+				}, http.StatusForbidden)
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			ctx := context.WithValue(r.Context(), apiKeyContextKey{}, key)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// requestCredentials returns the API key sent in the X-Auth-Token header or as
+// a bearer token. Sending the same key in both headers is allowed.
+func requestCredentials(r *http.Request) (string, error) {
+	token := r.Header.Get(AuthHeaderName)
+
+	scheme, bearer, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return token, nil
+	}
+	bearer = strings.TrimSpace(bearer)
+
+	if token != "" && token != bearer {
+		return "", errCredentialMismatch
+	}
+	return bearer, nil
+}
+
+// sendUnauthorized sends a 401 response saying why the key was rejected, with
+// a challenge telling clients how to authenticate.
+func sendUnauthorized(w http.ResponseWriter, providedToken string, err error) {
+	challenge := authChallenge
+	if providedToken != "" {
+		challenge += `, error="invalid_token"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+
+	switch {
+	case errors.Is(err, d1.ErrKeyExpired):
+		SendJSONError(w, ErrKeyExpired, http.StatusUnauthorized)
+	case errors.Is(err, d1.ErrKeyDisabled):
+		SendJSONError(w, ErrKeyDisabled, http.StatusUnauthorized)
+	default:
+		SendJSONError(w, ErrUnauthorized, http.StatusUnauthorized)
+	}
+}
+
+// apiKeyContextKey is the context key of the authenticated API key.
+type apiKeyContextKey struct{}
+
+// APIKeyFromContext returns the API key that authenticated the request, if
+// authentication is required.
+func APIKeyFromContext(ctx context.Context) (*d1.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey{}).(*d1.APIKey)
+	return key, ok
+}
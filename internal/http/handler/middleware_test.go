@@ -0,0 +1,257 @@
+//go:build !js || !wasm
+
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robalyx/roscoe/internal/service/d1"
+
+	_ "modernc.org/sqlite"
+)
+
+// newTestDB opens an in-memory SQLite database with the worker schema. It is
+// limited to one connection, as every connection would otherwise get its own
+// database.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if err := d1.InitSchema(context.Background(), db); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	return db
+}
+
+// addKey adds an API key with the given options and returns it.
+func addKey(t *testing.T, apiKeyService *d1.APIKeyService, opts d1.KeyOptions) string {
+	t.Helper()
+
+	key, err := d1.GenerateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	if _, err := apiKeyService.AddKey(context.Background(), key, opts); err != nil {
+		t.Fatalf("failed to add key: %v", err)
+	}
+	return key
+}
+
+// withTestAuth wraps h in AuthMiddleware as the worker does, recording the
+// last use of keys before returning.
+func withTestAuth(apiKeyService *d1.APIKeyService, scope string, h http.Handler) http.Handler {
+	return AuthMiddleware(apiKeyService, scope, func(task func()) { task() })(h)
+}
+
+// serve sends a request with the given headers and body to h.
+func serve(h http.Handler, method, target string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// errorMessage returns the message of a JSON error response.
+func errorMessage(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var resp ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode error response: %v", err)
+	}
+	return resp.Message
+}
+
+// okHandler replies with 200, recording whether it was called.
+func okHandler(called *bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		*called = true
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestAuthMiddlewareCredentials(t *testing.T) {
+	apiKeyService := d1.NewAPIKeyService(newTestDB(t))
+	key := addKey(t, apiKeyService, d1.KeyOptions{Scopes: []string{d1.ScopeLookupRead}})
+	otherKey := addKey(t, apiKeyService, d1.KeyOptions{Scopes: []string{d1.ScopeLookupRead}})
+
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		status    int
+		challenge string
+	}{
+		{
+			name:    "X-Auth-Token",
+			headers: map[string]string{AuthHeaderName: key},
+			status:  http.StatusOK,
+		},
+		{
+			name:    "bearer token",
+			headers: map[string]string{"Authorization": "Bearer " + key},
+			status:  http.StatusOK,
+		},
+		{
+			name:    "same key in both headers",
+			headers: map[string]string{AuthHeaderName: key, "Authorization": "bearer " + key},
+			status:  http.StatusOK,
+		},
+		{
+			name:      "different keys in both headers",
+			headers:   map[string]string{AuthHeaderName: key, "Authorization": "Bearer " + otherKey},
+			status:    http.StatusBadRequest,
+			challenge: `Bearer realm="roscoe", error="invalid_request"`,
+		},
+		{
+			name:      "no key",
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="roscoe"`,
+		},
+		{
+			name:      "unknown key",
+			headers:   map[string]string{"Authorization": "Bearer " + key + "x"},
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="roscoe", error="invalid_token"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			rec := serve(withTestAuth(apiKeyService, d1.ScopeLookupRead, okHandler(&called)),
+				http.MethodGet, "/lookup/roblox/user/1", tt.headers, "")
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if called != (tt.status == http.StatusOK) {
+				t.Errorf("handler called = %v with status %d", called, rec.Code)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); got != tt.challenge {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.challenge)
+			}
+			if tt.status == http.StatusBadRequest {
+				if got := errorMessage(t, rec); got != ErrConflictingCredentials.Message {
+					t.Errorf("message = %q, want %q", got, ErrConflictingCredentials.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareScopes(t *testing.T) {
+	apiKeyService := d1.NewAPIKeyService(newTestDB(t))
+	lookupKey := addKey(t, apiKeyService, d1.KeyOptions{Scopes: []string{d1.ScopeLookupRead}})
+	adminKey := addKey(t, apiKeyService, d1.KeyOptions{Scopes: []string{d1.ScopeAdmin}})
+
+	// Admin keys have every scope
+	var called bool
+	h := withTestAuth(apiKeyService, d1.ScopeQueueWrite, okHandler(&called))
+	rec := serve(h, http.MethodPost, "/queue/roblox/user", map[string]string{AuthHeaderName: adminKey}, "")
+	if rec.Code != http.StatusOK || !called {
+		t.Fatalf("admin key got status %d, want 200", rec.Code)
+	}
+
+	called = false
+	rec = serve(h, http.MethodPost, "/queue/roblox/user", map[string]string{AuthHeaderName: lookupKey}, "")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403: %s", rec.Code, rec.Body)
+	}
+	if called {
+		t.Error("handler was called for a key without the scope")
+	}
+	want := `Bearer realm="roscoe", error="insufficient_scope", scope="queue:write"`
+	if got := rec.Header().Get("WWW-Authenticate"); got != want {
+		t.Errorf("WWW-Authenticate = %q, want %q", got, want)
+	}
+	if got := errorMessage(t, rec); !strings.Contains(got, `"queue:write" scope`) {
+		t.Errorf("message = %q, want it to name the missing scope", got)
+	}
+}
+
+func TestAuthMiddlewareRejectedKeys(t *testing.T) {
+	ctx := context.Background()
+	apiKeyService := d1.NewAPIKeyService(newTestDB(t))
+	expiredKey := addKey(t, apiKeyService, d1.KeyOptions{
+		Scopes:    []string{d1.ScopeLookupRead},
+		ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+	})
+	disabledKey := addKey(t, apiKeyService, d1.KeyOptions{Scopes: []string{d1.ScopeLookupRead}})
+	if err := apiKeyService.SetDisabled(ctx, d1.KeyPrefix(disabledKey), true); err != nil {
+		t.Fatalf("failed to disable key: %v", err)
+	}
+
+	for key, want := range map[string]*ErrorResponse{
+		expiredKey:  ErrKeyExpired,
+		disabledKey: ErrKeyDisabled,
+	} {
+		var called bool
+		rec := serve(withTestAuth(apiKeyService, d1.ScopeLookupRead, okHandler(&called)),
+			http.MethodGet, "/lookup/roblox/user/1", map[string]string{AuthHeaderName: key}, "")
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want 401: %s", rec.Code, rec.Body)
+		}
+		if called {
+			t.Error("handler was called for a rejected key")
+		}
+		if got := rec.Header().Get("WWW-Authenticate"); got != `Bearer realm="roscoe", error="invalid_token"` {
+			t.Errorf("WWW-Authenticate = %q", got)
+		}
+		if got := errorMessage(t, rec); got != want.Message {
+			t.Errorf("message = %q, want %q", got, want.Message)
+		}
+	}
+}
+
+func TestAuthMiddlewareRecordsUseInBackground(t *testing.T) {
+	db := newTestDB(t)
+	apiKeyService := d1.NewAPIKeyService(db)
+	key := addKey(t, apiKeyService, d1.KeyOptions{Scopes: []string{d1.ScopeLookupRead}})
+
+	var tasks []func()
+	var called bool
+	h := AuthMiddleware(apiKeyService, d1.ScopeLookupRead, func(task func()) {
+		tasks = append(tasks, task)
+	})(okHandler(&called))
+
+	rec := serve(h, http.MethodGet, "/lookup/roblox/user/1", map[string]string{AuthHeaderName: key}, "")
+	if rec.Code != http.StatusOK || !called {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	// The response doesn't wait for the last use to be recorded
+	var lastUsedAt sql.NullInt64
+	readLastUse := func() {
+		t.Helper()
+		if err := db.QueryRow(`SELECT last_used_at FROM api_keys`).Scan(&lastUsedAt); err != nil {
+			t.Fatalf("failed to read last_used_at: %v", err)
+		}
+	}
+	readLastUse()
+	if lastUsedAt.Valid || len(tasks) != 1 {
+		t.Fatalf("last_used_at = %v with %d background tasks, want no use and 1 task", lastUsedAt, len(tasks))
+	}
+
+	tasks[0]()
+	readLastUse()
+	if now := time.Now().Unix(); !lastUsedAt.Valid || lastUsedAt.Int64 < now-60 || lastUsedAt.Int64 > now {
+		t.Errorf("last_used_at = %v, want about %d", lastUsedAt, now)
+	}
+}
@@ -3,18 +3,67 @@ package handler
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/robalyx/roscoe/internal/service/d1"
 )
 
+// queueMetadata is the optional source and priority of queued users.
+type queueMetadata struct {
+	Source   string `json:"source"`
+	Priority string `json:"priority"`
+}
+
 // queueRequest represents the request body for queueing a user.
 type queueRequest struct {
 	ID uint64 `json:"id"`
+	queueMetadata
+}
+
+// queueOutcomeInvalid is the outcome of a batch entry that isn't a valid user ID.
+const queueOutcomeInvalid = "invalid"
+
+// batchQueueRequest represents the request body for queueing several users.
+// IDs are checked one by one, so an invalid ID doesn't fail the batch.
+type batchQueueRequest struct {
+	IDs []json.RawMessage `json:"ids"`
+	queueMetadata
+}
+
+// QueueOutcomeResponse represents the outcome of queueing one user in a batch.
+// The ID is echoed as sent, so invalid IDs can be matched up.
+type QueueOutcomeResponse struct {
+	ID     json.RawMessage `json:"id"`
+	Status string          `json:"status"`
+}
+
+// defaultClaimSize is the number of users claimed when no limit is given.
+const defaultClaimSize = 10
+
+// ClaimedUserResponse represents a user leased to a queue consumer.
+type ClaimedUserResponse struct {
+	ID       uint64 `json:"id"`
+	QueuedAt int64  `json:"queuedAt"`
+	Source   string `json:"source,omitempty"`
+	Priority string `json:"priority"`
+}
+
+// ClaimResponse represents the response data for a queue claim. Results for
+// the claimed users must give the lease token.
+type ClaimResponse struct {
+	LeaseToken     string                `json:"leaseToken"`
+	LeaseExpiresAt int64                 `json:"leaseExpiresAt"`
+	Users          []ClaimedUserResponse `json:"users"`
 }
 
 // QueueUser handles requests to queue a user for processing.
-func QueueUser(queueService *d1.QueueService) http.HandlerFunc {
+func QueueUser(queueService *d1.QueueService, rateLimitService *d1.RateLimitService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req queueRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -36,9 +85,27 @@ func QueueUser(queueService *d1.QueueService) http.HandlerFunc {
 			return
 		}
 
+		opts, errorMsg := req.options(r)
+		if errorMsg != "" {
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		// Reserve the user from the key's daily queue quota, which is given
+		// back unless the user is queued
+		_, settleQuota, ok := reserveQueueQuota(w, r, rateLimitService, 1)
+		if !ok {
+			return
+		}
+
 		// Attempt to queue the user
-		err := queueService.QueueUser(r.Context(), req.ID)
+		err := queueService.QueueUser(r.Context(), req.ID, opts)
 		if err != nil {
+			settleQuota(0)
+
 			statusCode := http.StatusInternalServerError
 			errorMsg := "Failed to queue user"
 
@@ -47,7 +114,7 @@ func QueueUser(queueService *d1.QueueService) http.HandlerFunc {
 				errorMsg = "User is already flagged or confirmed"
 			} else if errors.Is(err, d1.ErrUserRecentlyQueued) {
 				statusCode = http.StatusConflict
-				errorMsg = "User was queued within the past 7 days"
+				errorMsg = "User was queued within the past " + formatCooldown(queueService.Cooldown())
 			}
 
 			SendJSONResponse(w, APIResponse{
@@ -58,9 +125,477 @@ func QueueUser(queueService *d1.QueueService) http.HandlerFunc {
 		}
 
 		// Success response
+		settleQuota(1)
 		SendJSONResponse(w, APIResponse{
 			Success: true,
 			Data:    map[string]uint64{"queued": req.ID},
 		}, http.StatusOK)
 	}
 }
+
+// QueueUsers handles requests to queue several users for processing, with
+// an outcome for each user.
+func QueueUsers(queueService *d1.QueueService, rateLimitService *d1.RateLimitService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req batchQueueRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorMsg := "Invalid request body"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		// Check if the batch size is too large
+		if len(req.IDs) > d1.MaxQueueBatchSize {
+			errorMsg := fmt.Sprintf("Batch size too large (max %d)", d1.MaxQueueBatchSize)
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		opts, errorMsg := req.options(r)
+		if errorMsg != "" {
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		// Parse IDs, leaving out invalid ones and duplicates
+		ids := make([]uint64, len(req.IDs))
+		valid := make([]uint64, 0, len(req.IDs))
+		for i, raw := range req.IDs {
+			if err := json.Unmarshal(raw, &ids[i]); err == nil && ids[i] != 0 {
+				valid = append(valid, ids[i])
+			} else {
+				ids[i] = 0
+			}
+		}
+		slices.Sort(valid)
+		valid = slices.Compact(valid)
+
+		// A batch that can never fit in the key's daily queue quota is rejected
+		if quota, fits := queueQuotaFits(r, len(valid)); !fits {
+			errorMsg := fmt.Sprintf("Batch of %d users exceeds the daily queue quota of %d", len(valid), quota)
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		// Reserve as many users as fit in the key's daily queue quota, giving
+		// back the ones that aren't queued
+		reserved, settleQuota, ok := reserveQueueQuota(w, r, rateLimitService, len(valid))
+		if !ok {
+			return
+		}
+
+		outcomes, err := queueService.QueueUsers(r.Context(), valid, opts, reserved)
+		if err != nil {
+			settleQuota(0)
+			log.Printf("Failed to queue users: %v", err)
+			errorMsg := "Failed to queue users"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusInternalServerError)
+			return
+		}
+
+		queued := 0
+		for _, outcome := range outcomes {
+			if outcome == d1.QueueOutcomeQueued {
+				queued++
+			}
+		}
+		settleQuota(queued)
+
+		data := make([]QueueOutcomeResponse, 0, len(req.IDs))
+		for i, raw := range req.IDs {
+			status := queueOutcomeInvalid
+			if ids[i] != 0 {
+				status = outcomes[ids[i]]
+			}
+			data = append(data, QueueOutcomeResponse{
+				ID:     raw,
+				Status: status,
+			})
+		}
+
+		SendJSONResponse(w, APIResponse{
+			Success: true,
+			Data:    data,
+		}, http.StatusOK)
+	}
+}
+
+// ClaimUsers handles requests from queue consumers to lease the oldest
+// unprocessed users. The limit and lease query parameters set how many users
+// are claimed and for how long, such as "?limit=50&lease=5m".
+func ClaimUsers(queueService *d1.QueueService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultClaimSize
+		if value := r.URL.Query().Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > d1.MaxClaimSize {
+				errorMsg := fmt.Sprintf("Invalid limit: must be between 1 and %d", d1.MaxClaimSize)
+				SendJSONResponse(w, APIResponse{
+					Success: false,
+					Error:   &errorMsg,
+				}, http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+
+		lease := d1.DefaultLeaseDuration
+		if value := r.URL.Query().Get("lease"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < time.Second || parsed > d1.MaxLeaseDuration {
+				errorMsg := fmt.Sprintf("Invalid lease: must be a duration between 1s and %s", d1.MaxLeaseDuration)
+				SendJSONResponse(w, APIResponse{
+					Success: false,
+					Error:   &errorMsg,
+				}, http.StatusBadRequest)
+				return
+			}
+			lease = parsed
+		}
+
+		leaseExpiresAt := time.Now().Add(lease)
+		users, leaseToken, err := queueService.ClaimUsers(r.Context(), limit, leaseExpiresAt)
+		if err != nil {
+			log.Printf("Failed to claim queued users: %v", err)
+			errorMsg := "Failed to claim queued users"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusInternalServerError)
+			return
+		}
+
+		response := ClaimResponse{
+			LeaseToken:     leaseToken,
+			LeaseExpiresAt: leaseExpiresAt.Unix(),
+			Users:          make([]ClaimedUserResponse, 0, len(users)),
+		}
+		for _, user := range users {
+			response.Users = append(response.Users, ClaimedUserResponse{
+				ID:       user.ID,
+				QueuedAt: user.QueuedAt,
+				Source:   user.Source,
+				Priority: d1.PriorityName(user.Priority),
+			})
+		}
+
+		SendJSONResponse(w, APIResponse{
+			Success: true,
+			Data:    response,
+		}, http.StatusOK)
+	}
+}
+
+// queueResult represents the outcome of processing one claimed user. Results
+// are processed unless processed is false, which releases the user back to
+// the queue.
+type queueResult struct {
+	ID         uint64            `json:"id"`
+	Processed  *bool             `json:"processed"`
+	Flagged    bool              `json:"flagged"`
+	Confidence *float64          `json:"confidence"`
+	Reasons    map[string]Reason `json:"reasons"`
+}
+
+// resultRequest represents the request body for reporting queue results of
+// users claimed with the given lease token.
+type resultRequest struct {
+	LeaseToken string        `json:"leaseToken"`
+	Results    []queueResult `json:"results"`
+}
+
+// ResultResponse represents the response data for reported queue results.
+// Ignored users weren't queued, were already processed or are no longer
+// leased with the given token.
+type ResultResponse struct {
+	Updated []uint64 `json:"updated"`
+	Ignored []uint64 `json:"ignored"`
+}
+
+// ReportResults handles requests from queue consumers to report the outcome
+// of processing claimed users.
+func ReportResults(queueService *d1.QueueService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req resultRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorMsg := "Invalid request body"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		results, errorMsg := parseResults(req.Results)
+		if req.LeaseToken == "" {
+			errorMsg = "Invalid lease token: must not be empty"
+		}
+		if errorMsg != "" {
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		updated, err := queueService.ReportResults(r.Context(), req.LeaseToken, results)
+		if err != nil {
+			log.Printf("Failed to record queue results: %v", err)
+			errorMsg := "Failed to record queue results"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusInternalServerError)
+			return
+		}
+
+		// Report every user that wasn't updated as ignored
+		response := ResultResponse{
+			Updated: append(make([]uint64, 0, len(updated)), updated...),
+			Ignored: make([]uint64, 0),
+		}
+		slices.Sort(response.Updated)
+		for _, result := range results {
+			if _, found := slices.BinarySearch(response.Updated, result.UserID); !found {
+				response.Ignored = append(response.Ignored, result.UserID)
+			}
+		}
+
+		SendJSONResponse(w, APIResponse{
+			Success: true,
+			Data:    response,
+		}, http.StatusOK)
+	}
+}
+
+// parseResults validates reported results and converts them for the queue
+// service, or returns a message describing why they are invalid.
+func parseResults(results []queueResult) ([]d1.QueueResult, string) {
+	if len(results) == 0 {
+		return nil, "Invalid results: must not be empty"
+	}
+	if len(results) > d1.MaxClaimSize {
+		return nil, fmt.Sprintf("Batch size too large (max %d)", d1.MaxClaimSize)
+	}
+
+	seen := make(map[uint64]bool, len(results))
+	parsed := make([]d1.QueueResult, 0, len(results))
+	for _, result := range results {
+		switch {
+		case result.ID == 0:
+			return nil, "Invalid ID in results: must be greater than 0"
+		case seen[result.ID]:
+			return nil, fmt.Sprintf("Duplicate ID in results: %d", result.ID)
+		case result.Confidence != nil && (*result.Confidence < 0 || *result.Confidence > 1):
+			return nil, fmt.Sprintf("Invalid confidence for user %d: must be between 0 and 1", result.ID)
+		}
+		seen[result.ID] = true
+
+		queueResult := d1.QueueResult{
+			UserID:     result.ID,
+			Processed:  result.Processed == nil || *result.Processed,
+			Flagged:    result.Flagged,
+			Confidence: result.Confidence,
+		}
+		if len(result.Reasons) > 0 {
+			reasons, err := json.Marshal(result.Reasons)
+			if err != nil {
+				return nil, fmt.Sprintf("Invalid reasons for user %d", result.ID)
+			}
+			queueResult.Reasons = string(reasons)
+		}
+		parsed = append(parsed, queueResult)
+	}
+
+	return parsed, ""
+}
+
+// QueueStatusResponse represents the queue status of a user. Details of the
+// submission are omitted if the user isn't queued or they weren't recorded,
+// and the submitter and source are only shown to the key that submitted the
+// user and to admins.
+type QueueStatusResponse struct {
+	ID          uint64 `json:"id"`
+	Status      string `json:"status"`
+	QueuedAt    *int64 `json:"queuedAt,omitempty"`
+	ProcessedAt *int64 `json:"processedAt,omitempty"`
+	SubmittedBy *int64 `json:"submittedBy,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Priority    string `json:"priority,omitempty"`
+}
+
+// QueueStatus handles requests for the queue status of a single user.
+func QueueStatus(queueService *d1.QueueService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract ID from path
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 5 {
+			errorMsg := "Invalid path"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		// Parse and validate ID
+		id, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil || id == 0 {
+			errorMsg := "Invalid ID: must be a number greater than 0"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		statuses, err := queueService.GetQueueStatuses(r.Context(), []uint64{id})
+		if err != nil {
+			log.Printf("Failed to get queue status: %v", err)
+			errorMsg := "Internal server error"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusInternalServerError)
+			return
+		}
+
+		SendJSONResponse(w, APIResponse{
+			Success: true,
+			Data:    newQueueStatusResponse(r, statuses[id]),
+		}, http.StatusOK)
+	}
+}
+
+// BatchQueueStatus handles requests for the queue status of several users.
+func BatchQueueStatus(queueService *d1.QueueService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req lookupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorMsg := "Invalid request body"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		// Check if the batch size is too large
+		if len(req.IDs) > 100 {
+			errorMsg := "Batch size too large (max 100)"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		// Validate IDs
+		if slices.Contains(req.IDs, uint64(0)) {
+			errorMsg := "Invalid ID in batch: must be greater than 0"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		statuses, err := queueService.GetQueueStatuses(r.Context(), req.IDs)
+		if err != nil {
+			log.Printf("Failed to get queue status: %v", err)
+			errorMsg := "Internal server error"
+			SendJSONResponse(w, APIResponse{
+				Success: false,
+				Error:   &errorMsg,
+			}, http.StatusInternalServerError)
+			return
+		}
+
+		data := make([]QueueStatusResponse, 0, len(req.IDs))
+		for _, id := range req.IDs {
+			data = append(data, newQueueStatusResponse(r, statuses[id]))
+		}
+
+		SendJSONResponse(w, APIResponse{
+			Success: true,
+			Data:    data,
+		}, http.StatusOK)
+	}
+}
+
+// newQueueStatusResponse converts a queue status to its response form for the
+// key that authenticated the request. Without authentication every caller is
+// treated alike, so the submission details are shown.
+func newQueueStatusResponse(r *http.Request, status d1.QueueStatus) QueueStatusResponse {
+	response := QueueStatusResponse{
+		ID:          status.UserID,
+		Status:      status.Status,
+		QueuedAt:    nilIfZero(status.QueuedAt),
+		ProcessedAt: nilIfZero(status.ProcessedAt),
+	}
+	if status.Status != d1.QueueStatusNotQueued {
+		response.Priority = d1.PriorityName(status.Priority)
+	}
+
+	key, ok := APIKeyFromContext(r.Context())
+	if !ok || key.ID == status.SubmittedBy || key.HasScope(d1.ScopeAdmin) {
+		response.SubmittedBy = nilIfZero(status.SubmittedBy)
+		response.Source = status.Source
+	}
+	return response
+}
+
+// options validates the source and priority and returns the options to queue
+// users with, or a message describing why they are invalid. Users are
+// recorded as submitted by the key that authenticated the request.
+func (m *queueMetadata) options(r *http.Request) (d1.QueueOptions, string) {
+	if len(m.Source) > d1.MaxSourceLength {
+		return d1.QueueOptions{}, fmt.Sprintf("Invalid source: must be at most %d characters", d1.MaxSourceLength)
+	}
+
+	priority, err := d1.ParsePriority(m.Priority)
+	if err != nil {
+		return d1.QueueOptions{}, "Invalid priority: must be low, normal or high"
+	}
+
+	opts := d1.QueueOptions{
+		Source:   m.Source,
+		Priority: priority,
+	}
+	if key, ok := APIKeyFromContext(r.Context()); ok {
+		opts.SubmittedBy = key.ID
+	}
+	return opts, ""
+}
+
+// formatCooldown formats the queue cooldown for error messages, such as
+// "7 days" or "12 hours".
+func formatCooldown(cooldown time.Duration) string {
+	switch {
+	case cooldown == 24*time.Hour:
+		return "day"
+	case cooldown%(24*time.Hour) == 0:
+		return fmt.Sprintf("%d days", cooldown/(24*time.Hour))
+	case cooldown == time.Hour:
+		return "hour"
+	case cooldown%time.Hour == 0:
+		return fmt.Sprintf("%d hours", cooldown/time.Hour)
+	default:
+		return cooldown.String()
+	}
+}
@@ -0,0 +1,189 @@
+//go:build !js || !wasm
+
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/robalyx/roscoe/internal/service/d1"
+)
+
+// newTestQueue returns a queue service with a one hour cooldown.
+func newTestQueue(db *sql.DB) *d1.QueueService {
+	return d1.NewQueueService(db, d1.NewFlagService(db), time.Hour)
+}
+
+// decodeResponse decodes a JSON API response, storing its data in data.
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder, data any) APIResponse {
+	t.Helper()
+
+	var resp struct {
+		APIResponse
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if data != nil && resp.Data != nil {
+		if err := json.Unmarshal(resp.Data, data); err != nil {
+			t.Fatalf("failed to decode response data: %v", err)
+		}
+	}
+	return resp.APIResponse
+}
+
+func TestQueueQuota(t *testing.T) {
+	db := newTestDB(t)
+	apiKeyService := d1.NewAPIKeyService(db)
+	queueService := newTestQueue(db)
+	rateLimitService := d1.NewRateLimitService(db)
+	key := addKey(t, apiKeyService, d1.KeyOptions{Scopes: []string{d1.ScopeQueueWrite}, DailyQueueQuota: 3})
+	headers := map[string]string{AuthHeaderName: key}
+
+	awaitWindow(24 * time.Hour)
+	queueUser := withTestAuth(apiKeyService, d1.ScopeQueueWrite, QueueUser(queueService, rateLimitService))
+	queueUsers := withTestAuth(apiKeyService, d1.ScopeQueueWrite, QueueUsers(queueService, rateLimitService))
+
+	// queueBatch queues ids and checks the outcomes and remaining quota
+	queueBatch := func(body string, want map[string]string, remaining string) {
+		t.Helper()
+
+		rec := serve(queueUsers, http.MethodPost, "/queue/roblox/users", headers, body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("batch %s status = %d, want 200: %s", body, rec.Code, rec.Body)
+		}
+		var outcomes []QueueOutcomeResponse
+		decodeResponse(t, rec, &outcomes)
+		if len(outcomes) != len(want) {
+			t.Fatalf("batch %s has %d outcomes, want %d", body, len(outcomes), len(want))
+		}
+		for _, outcome := range outcomes {
+			if want[string(outcome.ID)] != outcome.Status {
+				t.Errorf("batch %s: user %s is %s, want %s", body, outcome.ID, outcome.Status, want[string(outcome.ID)])
+			}
+		}
+		if got := rec.Header().Get("X-RateLimit-Queue-Remaining"); got != remaining {
+			t.Errorf("batch %s: X-RateLimit-Queue-Remaining = %q, want %s", body, got, remaining)
+		}
+	}
+
+	rec := serve(queueUser, http.MethodPost, "/queue/roblox/user", headers, `{"id": 10}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("X-RateLimit-Queue-Limit"); got != "3" {
+		t.Errorf("X-RateLimit-Queue-Limit = %q, want 3", got)
+	}
+	if got := rec.Header().Get("X-RateLimit-Queue-Remaining"); got != "2" {
+		t.Errorf("X-RateLimit-Queue-Remaining = %q, want 2", got)
+	}
+
+	// A batch larger than the whole quota is rejected, counting each user once
+	rec = serve(queueUsers, http.MethodPost, "/queue/roblox/users", headers, `{"ids": [1, 2, 2, 3, 4]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("oversized batch status = %d, want 400: %s", rec.Code, rec.Body)
+	}
+	if resp := decodeResponse(t, rec, nil); resp.Error == nil ||
+		*resp.Error != "Batch of 4 users exceeds the daily queue quota of 3" {
+		t.Errorf("oversized batch error = %v", resp.Error)
+	}
+
+	// Users that aren't queued don't use up the quota
+	queueBatch(`{"ids": [10, 0]}`, map[string]string{
+		"10": d1.QueueOutcomeRecentlyQueued, "0": queueOutcomeInvalid,
+	}, "2")
+
+	// Users beyond the remaining quota are reported instead of queued
+	queueBatch(`{"ids": [11, 12, 13]}`, map[string]string{
+		"11": d1.QueueOutcomeQueued, "12": d1.QueueOutcomeQueued, "13": d1.QueueOutcomeQuotaExceeded,
+	}, "0")
+
+	rec = serve(queueUser, http.MethodPost, "/queue/roblox/user", headers, `{"id": 14}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status with no quota left = %d, want 429: %s", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("429 response has no Retry-After header")
+	}
+
+	var queued int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM queued_users`).Scan(&queued); err != nil {
+		t.Fatalf("failed to read queued_users: %v", err)
+	}
+	if queued != 3 {
+		t.Errorf("queued users = %d, want 3", queued)
+	}
+}
+
+func TestReportResultsLeaseToken(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	queueService := newTestQueue(db)
+	for _, id := range []uint64{1, 2} {
+		if err := queueService.QueueUser(ctx, id, d1.QueueOptions{}); err != nil {
+			t.Fatalf("failed to queue user %d: %v", id, err)
+		}
+	}
+
+	rec := serve(ClaimUsers(queueService), http.MethodPost, "/queue/roblox/user/claim?limit=1", nil, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("claim status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var claim ClaimResponse
+	decodeResponse(t, rec, &claim)
+	if len(claim.Users) != 1 || claim.LeaseToken == "" {
+		t.Fatalf("claimed %d users with lease token %q, want 1 user and a token", len(claim.Users), claim.LeaseToken)
+	}
+	claimed := claim.Users[0].ID
+
+	report := func(leaseToken string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"leaseToken": %q, "results": [{"id": 1, "flagged": false}, {"id": 2, "flagged": false}]}`,
+			leaseToken)
+		return serve(ReportResults(queueService), http.MethodPost, "/queue/roblox/user/result", nil, body)
+	}
+
+	rec = report("")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status without a lease token = %d, want 400: %s", rec.Code, rec.Body)
+	}
+	if resp := decodeResponse(t, rec, nil); resp.Error == nil || *resp.Error != "Invalid lease token: must not be empty" {
+		t.Errorf("error without a lease token = %v", resp.Error)
+	}
+
+	// Results reported with another token are ignored, as are users that
+	// aren't leased
+	for _, tt := range []struct {
+		leaseToken string
+		updated    []uint64
+	}{
+		{leaseToken: claim.LeaseToken + "x", updated: []uint64{}},
+		{leaseToken: claim.LeaseToken, updated: []uint64{claimed}},
+	} {
+		rec = report(tt.leaseToken)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+		}
+		var result ResultResponse
+		decodeResponse(t, rec, &result)
+		if !slices.Equal(result.Updated, tt.updated) || len(result.Ignored) != 2-len(tt.updated) {
+			t.Errorf("lease token %q updated %v and ignored %v, want %v updated",
+				tt.leaseToken, result.Updated, result.Ignored, tt.updated)
+		}
+	}
+
+	var processed int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM queued_users WHERE processed_at IS NOT NULL`).Scan(&processed); err != nil {
+		t.Fatalf("failed to read queued_users: %v", err)
+	}
+	if processed != 1 {
+		t.Errorf("processed users = %d, want 1", processed)
+	}
+}
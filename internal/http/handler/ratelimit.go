@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/robalyx/roscoe/internal/service/d1"
+)
+
+// RateLimitMiddleware enforces the per-minute request limit of the API key
+// that authenticated the request. It must run after AuthMiddleware.
+func RateLimitMiddleware(rateLimitService *d1.RateLimitService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := APIKeyFromContext(r.Context())
+			if !ok || key.RequestsPerMinute == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			limit, err := rateLimitService.Consume(
+				r.Context(), key.ID, d1.CounterRequests, time.Minute, key.RequestsPerMinute, 1,
+			)
+			if err != nil {
+				log.Printf("Failed to check rate limit of API key %d: %v", key.ID, err)
+				SendJSONError(w, ErrInternal, http.StatusInternalServerError)
+				return
+			}
+
+			setRateLimitHeaders(w, "", limit)
+			if !limit.Allowed {
+				sendRateLimited(w, limit, fmt.Sprintf("Rate limit of %d requests per minute exceeded", limit.Limit))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// consumeIDQuota takes count IDs from the daily lookup quota of the API key
+// that authenticated the request. If the quota doesn't allow it, it sends a
+// 429 response and returns false.
+func consumeIDQuota(w http.ResponseWriter, r *http.Request, rateLimitService *d1.RateLimitService, count int) bool {
+	key, ok := APIKeyFromContext(r.Context())
+	if !ok || key.DailyIDQuota == 0 {
+		return true
+	}
+	_, allowed := consumeDailyQuota(
+		w, r, rateLimitService, key.ID, d1.CounterIDs, key.DailyIDQuota, count, "IDs-", "looked up IDs",
+	)
+	return allowed
+}
+
+// reserveQueueQuota reserves as many of count users as fit in the remaining
+// daily queue quota of the API key that authenticated the request, and returns
+// how many were reserved. If none of the quota remains, it sends a 429
+// response and returns false. Otherwise it also returns a function to call
+// with the number of users actually queued, which gives back the rest.
+func reserveQueueQuota(
+	w http.ResponseWriter, r *http.Request, rateLimitService *d1.RateLimitService, count int,
+) (int, func(queued int), bool) {
+	key, ok := APIKeyFromContext(r.Context())
+	if !ok || key.DailyQueueQuota == 0 || count == 0 {
+		return count, func(int) {}, true
+	}
+
+	current, err := rateLimitService.Peek(r.Context(), key.ID, d1.CounterQueue, 24*time.Hour, key.DailyQueueQuota)
+	if err != nil {
+		log.Printf("Failed to check queue quota of API key %d: %v", key.ID, err)
+		SendJSONError(w, ErrInternal, http.StatusInternalServerError)
+		return 0, nil, false
+	}
+
+	// With none of the quota left, reserving one user fails with a 429
+	reserved := int(min(int64(count), max(current.Remaining, 1)))
+	limit, allowed := consumeDailyQuota(
+		w, r, rateLimitService, key.ID, d1.CounterQueue, key.DailyQueueQuota, reserved, "Queue-", "queued users",
+	)
+	if !allowed {
+		return 0, nil, false
+	}
+
+	return reserved, func(queued int) {
+		err := rateLimitService.Refund(r.Context(), key.ID, d1.CounterQueue, limit, int64(reserved-queued))
+		if err != nil {
+			log.Printf("Failed to refund queue quota of API key %d: %v", key.ID, err)
+			return
+		}
+		setRateLimitHeaders(w, "Queue-", limit)
+	}, true
+}
+
+// queueQuotaFits reports whether count users fit in the daily queue quota of
+// the API key that authenticated the request at all.
+func queueQuotaFits(r *http.Request, count int) (int64, bool) {
+	key, ok := APIKeyFromContext(r.Context())
+	if !ok || key.DailyQueueQuota == 0 {
+		return 0, true
+	}
+	return key.DailyQueueQuota, int64(count) <= key.DailyQueueQuota
+}
+
+// consumeDailyQuota takes count from a daily counter of an API key, setting
+// the X-RateLimit-{name} headers. If the quota doesn't allow it, it sends a
+// 429 response describing what is counted and returns false.
+func consumeDailyQuota(
+	w http.ResponseWriter, r *http.Request, rateLimitService *d1.RateLimitService,
+	keyID int64, counter string, quota int64, count int, name, what string,
+) (*d1.RateLimit, bool) {
+	limit, err := rateLimitService.Consume(r.Context(), keyID, counter, 24*time.Hour, quota, int64(count))
+	if err != nil {
+		log.Printf("Failed to check %s quota of API key %d: %v", counter, keyID, err)
+		SendJSONError(w, ErrInternal, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	setRateLimitHeaders(w, name, limit)
+	if !limit.Allowed {
+		sendRateLimited(w, limit, fmt.Sprintf(
+			"Daily quota of %d %s exceeded (%d remaining)", limit.Limit, what, limit.Remaining,
+		))
+		return nil, false
+	}
+	return limit, true
+}
+
+// setRateLimitHeaders sets the X-RateLimit-{name}Limit, -Remaining and -Reset
+// headers describing a limit. Reset is a Unix time.
+func setRateLimitHeaders(w http.ResponseWriter, name string, limit *d1.RateLimit) {
+	w.Header().Set("X-RateLimit-"+name+"Limit", strconv.FormatInt(limit.Limit, 10))
+	w.Header().Set("X-RateLimit-"+name+"Remaining", strconv.FormatInt(limit.Remaining, 10))
+	w.Header().Set("X-RateLimit-"+name+"Reset", strconv.FormatInt(limit.Reset.Unix(), 10))
+}
+
+// sendRateLimited sends a 429 response telling the client when to retry.
+func sendRateLimited(w http.ResponseWriter, limit *d1.RateLimit, message string) {
+	retryAfter := limit.RetryAfter(time.Now())
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(max(seconds, 1), 10))
+	SendJSONError(w, &ErrorResponse{Message: "Too Many Requests: " + message}, http.StatusTooManyRequests)
+}
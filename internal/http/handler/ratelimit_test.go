@@ -0,0 +1,77 @@
+//go:build !js || !wasm
+
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/robalyx/roscoe/internal/service/d1"
+)
+
+// awaitWindow waits for the next rate limit window if the current one ends
+// within a second, so a test's requests all count against the same window.
+func awaitWindow(window time.Duration) {
+	now := time.Now()
+	if untilReset := now.Truncate(window).Add(window).Sub(now); untilReset < time.Second {
+		time.Sleep(untilReset)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	db := newTestDB(t)
+	apiKeyService := d1.NewAPIKeyService(db)
+	limitedKey := addKey(t, apiKeyService, d1.KeyOptions{Scopes: []string{d1.ScopeLookupRead}, RequestsPerMinute: 2})
+	unlimitedKey := addKey(t, apiKeyService, d1.KeyOptions{Scopes: []string{d1.ScopeLookupRead}})
+
+	awaitWindow(time.Minute)
+	var called bool
+	h := withTestAuth(apiKeyService, d1.ScopeLookupRead,
+		RateLimitMiddleware(d1.NewRateLimitService(db))(okHandler(&called)))
+
+	for i, remaining := range []string{"1", "0"} {
+		rec := serve(h, http.MethodGet, "/lookup/roblox/user/1", map[string]string{AuthHeaderName: limitedKey}, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d status = %d, want 200: %s", i+1, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("X-RateLimit-Limit"); got != "2" {
+			t.Errorf("X-RateLimit-Limit = %q, want 2", got)
+		}
+		if got := rec.Header().Get("X-RateLimit-Remaining"); got != remaining {
+			t.Errorf("request %d X-RateLimit-Remaining = %q, want %s", i+1, got, remaining)
+		}
+	}
+
+	called = false
+	rec := serve(h, http.MethodGet, "/lookup/roblox/user/1", map[string]string{AuthHeaderName: limitedKey}, "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429: %s", rec.Code, rec.Body)
+	}
+	if called {
+		t.Error("handler was called over the rate limit")
+	}
+	if got := rec.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("X-RateLimit-Remaining = %q, want 0", got)
+	}
+
+	// The client is told to retry once the minute window resets
+	retryAfter, err := strconv.ParseInt(rec.Header().Get("Retry-After"), 10, 64)
+	if err != nil || retryAfter < 1 || retryAfter > 60 {
+		t.Errorf("Retry-After = %q, want 1 to 60 seconds", rec.Header().Get("Retry-After"))
+	}
+	reset, err := strconv.ParseInt(rec.Header().Get("X-RateLimit-Reset"), 10, 64)
+	if now := time.Now().Unix(); err != nil || reset <= now || reset > now+60 {
+		t.Errorf("X-RateLimit-Reset = %q, want within the next minute", rec.Header().Get("X-RateLimit-Reset"))
+	}
+
+	// Keys without a limit aren't counted
+	rec = serve(h, http.MethodGet, "/lookup/roblox/user/1", map[string]string{AuthHeaderName: unlimitedKey}, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unlimited key status = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get("X-RateLimit-Limit"); got != "" {
+		t.Errorf("unlimited key X-RateLimit-Limit = %q, want none", got)
+	}
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/robalyx/roscoe/internal/service/d1"
+)
+
+// usageContextKey is the context key of the usage counts of a request.
+type usageContextKey struct{}
+
+// statusRecorder remembers the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// UsageMiddleware records the usage of the API key that authenticated the
+// request. It must run after AuthMiddleware. When buffered usage is due to be
+// written, the write is passed to background so it doesn't delay the response.
+func UsageMiddleware(usageRecorder *d1.UsageRecorder, background func(task func())) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := APIKeyFromContext(r.Context())
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			counts := &d1.UsageCounts{Requests: 1}
+			rw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			ctx := context.WithValue(r.Context(), usageContextKey{}, counts)
+			next.ServeHTTP(rw, r.WithContext(ctx))
+
+			if rw.status >= http.StatusBadRequest {
+				counts.Errors = 1
+			}
+
+			if usageRecorder.Record(key.ID, r.Method+" "+r.Pattern, *counts) {
+				background(func() {
+					if err := usageRecorder.Flush(context.Background()); err != nil {
+						log.Printf("Failed to write API key usage: %v", err)
+					}
+				})
+			}
+		})
+	}
+}
+
+// recordLookup adds looked up and flagged IDs to the usage of a request.
+func recordLookup(ctx context.Context, ids, flagged int) {
+	if counts, ok := ctx.Value(usageContextKey{}).(*d1.UsageCounts); ok {
+		counts.IDs += int64(ids)
+		counts.Flagged += int64(flagged)
+	}
+}
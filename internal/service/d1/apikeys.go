@@ -3,82 +3,292 @@ package d1
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strings"
 	"time"
 )
 
-var ErrKeyNotFound = errors.New("key not found")
+const (
+	// KeyPrefixLength is the number of leading key characters stored in
+	// plaintext to identify a key.
+	KeyPrefixLength = 8
 
-// APIKey represents an API key record.
+	// MinKeyLength is the shortest key accepted, so the prefix never
+	// reveals most of the secret.
+	MinKeyLength = 16
+)
+
+// API key scopes. A key with the admin scope has every other scope too.
+const (
+	ScopeLookupRead   = "lookup:read"
+	ScopeQueueWrite   = "queue:write"
+	ScopeQueueProcess = "queue:process"
+	ScopeAdmin        = "admin"
+)
+
+// defaultScopesSQL is the scopes value of keys created without explicit
+// scopes, matching what every key could do before scopes existed.
+const defaultScopesSQL = "'lookup:read queue:write'"
+
+var (
+	ErrKeyNotFound  = errors.New("key not found")
+	ErrInvalidKey   = errors.New("invalid API key")
+	ErrKeyExpired   = fmt.Errorf("%w: key has expired", ErrInvalidKey)
+	ErrKeyDisabled  = fmt.Errorf("%w: key is disabled", ErrInvalidKey)
+	ErrKeyTooShort  = fmt.Errorf("key must be at least %d characters", MinKeyLength)
+	ErrAmbiguousKey = errors.New("key reference matches more than one key")
+	ErrUnknownScope = errors.New("unknown scope")
+	ErrKeyRotated   = errors.New("key was already rotated")
+)
+
+// DefaultScopes are the scopes given to keys created without explicit scopes.
+var DefaultScopes = []string{ScopeLookupRead, ScopeQueueWrite}
+
+// API key statuses.
+const (
+	KeyStatusActive   = "active"
+	KeyStatusExpired  = "expired"
+	KeyStatusDisabled = "disabled"
+)
+
+// APIKeyFields are the api_keys columns that describe an APIKey.
+const APIKeyFields = "id, prefix, description, scopes, expires_at, disabled, last_used_at, " +
+	"requests_per_minute, daily_id_quota, daily_queue_quota, replaced_by, rotated_at, created_at"
+
+// lastUsedPrecision is how stale a key's last-used time may get before a
+// request updates it, so busy keys don't cost a write per request.
+const lastUsedPrecision = time.Minute
+
+// APIKey represents an API key record. The key itself is never stored.
+// ExpiresAt and LastUsedAt are zero if the key never expires or was never
+// used, and a zero limit means the key is unlimited. A rotated key records
+// the ID of the key that replaced it and when it was rotated.
 type APIKey struct {
-	Key         string
-	Description string
-	CreatedAt   int64
+	ID                int64
+	Prefix            string
+	Description       string
+	Scopes            []string
+	ExpiresAt         int64
+	Disabled          bool
+	LastUsedAt        int64
+	RequestsPerMinute int64
+	DailyIDQuota      int64
+	DailyQueueQuota   int64
+	ReplacedBy        int64
+	RotatedAt         int64
+	CreatedAt         int64
+}
+
+// Options returns the settings of the key, for creating a key like it.
+func (k *APIKey) Options() KeyOptions {
+	return KeyOptions{
+		Description:       k.Description,
+		Scopes:            k.Scopes,
+		ExpiresAt:         k.ExpiresAt,
+		RequestsPerMinute: k.RequestsPerMinute,
+		DailyIDQuota:      k.DailyIDQuota,
+		DailyQueueQuota:   k.DailyQueueQuota,
+	}
 }
 
-// APIKeyService handles API key operations in D1.
+// KeyOptions are the settings of a new API key. Zero values mean no expiry
+// and no limits.
+type KeyOptions struct {
+	Description       string
+	Scopes            []string
+	ExpiresAt         int64
+	RequestsPerMinute int64
+	DailyIDQuota      int64
+	DailyQueueQuota   int64
+}
+
+// Status returns whether the key is active, expired or disabled at the given time.
+func (k *APIKey) Status(now time.Time) string {
+	switch {
+	case k.Disabled:
+		return KeyStatusDisabled
+	case k.ExpiresAt != 0 && now.Unix() >= k.ExpiresAt:
+		return KeyStatusExpired
+	default:
+		return KeyStatusActive
+	}
+}
+
+// HasScope reports whether the key grants the given scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// HashedKey is the stored form of an API key.
+type HashedKey struct {
+	Prefix string
+	Hash   string
+	Salt   string
+}
+
+// APIKeyService handles API key operations in D1. Authentication results are
+// cached in memory and refreshed when keys change.
 type APIKeyService struct {
-	db *sql.DB
+	db    *sql.DB
+	cache *keyCache
 }
 
 // NewAPIKeyService creates a new API key service.
 func NewAPIKeyService(db *sql.DB) *APIKeyService {
 	return &APIKeyService{
-		db: db,
+		db:    db,
+		cache: newKeyCache(),
 	}
 }
 
-// AddKey adds a new API key.
-func (s *APIKeyService) AddKey(ctx context.Context, key, description string) error {
-	_, err := s.db.ExecContext(ctx,
-		"INSERT INTO api_keys (key, description, created_at) VALUES (?, ?, ?)",
-		key, description, time.Now().Unix(),
-	)
+// AddKey stores the hash of a new API key and returns its ID.
+func (s *APIKeyService) AddKey(ctx context.Context, key string, opts KeyOptions) (int64, error) {
+	hashed, err := HashKey(key)
 	if err != nil {
-		return fmt.Errorf("error adding API key: %w", err)
+		return 0, err
 	}
-	return nil
+
+	result, err := s.db.ExecContext(ctx, InsertKeySQL, opts.InsertParams(hashed)...)
+	if err != nil {
+		return 0, fmt.Errorf("error adding API key: %w", err)
+	}
+
+	s.cache.reset()
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error getting key ID: %w", err)
+	}
+	return id, nil
 }
 
-// RemoveKey removes an API key.
-func (s *APIKeyService) RemoveKey(ctx context.Context, key string) error {
-	result, err := s.db.ExecContext(ctx, "DELETE FROM api_keys WHERE key = ?", key)
+// RemoveKey removes the API key matching ref, which is a key ID, prefix or full key.
+func (s *APIKeyService) RemoveKey(ctx context.Context, ref string) error {
+	id, err := s.resolveKey(ctx, ref)
 	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM api_keys WHERE id = ?", id); err != nil {
 		return fmt.Errorf("error removing API key: %w", err)
 	}
+	s.cache.reset()
+	return nil
+}
 
-	rows, err := result.RowsAffected()
+// SetDisabled disables or re-enables the API key matching ref.
+func (s *APIKeyService) SetDisabled(ctx context.Context, ref string, disabled bool) error {
+	id, err := s.resolveKey(ctx, ref)
 	if err != nil {
-		return fmt.Errorf("error getting rows affected: %w", err)
+		return err
+	}
+
+	if _, err := s.db.ExecContext(ctx, "UPDATE api_keys SET disabled = ? WHERE id = ?", disabled, id); err != nil {
+		return fmt.Errorf("error updating API key: %w", err)
 	}
-	if rows == 0 {
-		return ErrKeyNotFound
+	s.cache.reset()
+	return nil
+}
+
+// TouchKey records that a key was just used, unless it was already recorded
+// as used within the last minute.
+func (s *APIKeyService) TouchKey(ctx context.Context, key *APIKey) error {
+	now := time.Now()
+	if now.Sub(time.Unix(key.LastUsedAt, 0)) < lastUsedPrecision {
+		return nil
 	}
 
+	if _, err := s.db.ExecContext(ctx,
+		"UPDATE api_keys SET last_used_at = ? WHERE id = ?",
+		now.Unix(), key.ID,
+	); err != nil {
+		return fmt.Errorf("error recording API key use: %w", err)
+	}
+	key.LastUsedAt = now.Unix()
+	s.cache.touch(key.ID, key.LastUsedAt)
 	return nil
 }
 
 // ValidateKey checks if an API key is valid.
 func (s *APIKeyService) ValidateKey(ctx context.Context, key string) (bool, error) {
-	var exists bool
-	err := s.db.QueryRowContext(ctx,
-		"SELECT EXISTS(SELECT 1 FROM api_keys WHERE key = ?)",
-		key,
-	).Scan(&exists)
+	_, err := s.Authenticate(ctx, key)
+	if errors.Is(err, ErrInvalidKey) {
+		return false, nil
+	}
 	if err != nil {
-		return false, fmt.Errorf("error validating API key: %w", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// Authenticate returns the record of a valid API key. It returns an error
+// wrapping ErrInvalidKey if the key is unknown, expired or disabled.
+func (s *APIKeyService) Authenticate(ctx context.Context, key string) (*APIKey, error) {
+	if len(key) < MinKeyLength {
+		return nil, ErrInvalidKey
+	}
+
+	now := time.Now()
+	s.cache.checkVersion(ctx, s.db, now)
+
+	record, ok := s.cache.get(key, now)
+	if !ok {
+		var err error
+		record, err = s.lookupKey(ctx, key)
+		if err != nil && !errors.Is(err, ErrInvalidKey) {
+			return nil, err
+		}
+		s.cache.put(key, record, now)
 	}
-	return exists, nil
+	if record == nil {
+		return nil, ErrInvalidKey
+	}
+
+	switch record.Status(now) {
+	case KeyStatusDisabled:
+		return nil, ErrKeyDisabled
+	case KeyStatusExpired:
+		return nil, ErrKeyExpired
+	}
+	return record, nil
+}
+
+// lookupKey returns the record of the key from D1, whatever its status. It
+// returns ErrInvalidKey if no key matches.
+func (s *APIKeyService) lookupKey(ctx context.Context, key string) (*APIKey, error) {
+	var hash, salt string
+	record, err := scanAPIKey(s.db.QueryRowContext(ctx,
+		"SELECT key_hash, salt, "+APIKeyFields+" FROM api_keys WHERE prefix = ?",
+		KeyPrefix(key),
+	), &hash, &salt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error validating API key: %w", err)
+	}
+
+	if !verifyKey(key, salt, hash) {
+		return nil, ErrInvalidKey
+	}
+	return record, nil
 }
 
 // ListKeys returns all API keys.
 func (s *APIKeyService) ListKeys(ctx context.Context) ([]APIKey, error) {
 	rows, err := s.db.QueryContext(ctx,
-		"SELECT key, description, created_at FROM api_keys ORDER BY created_at DESC",
+		"SELECT "+APIKeyFields+" FROM api_keys ORDER BY created_at DESC, id DESC",
 	)
 	if err != nil {
 		return nil, fmt.Errorf("error querying API keys: %w", err)
@@ -87,11 +297,11 @@ func (s *APIKeyService) ListKeys(ctx context.Context) ([]APIKey, error) {
 
 	var keys []APIKey
 	for rows.Next() {
-		var key APIKey
-		if err := rows.Scan(&key.Key, &key.Description, &key.CreatedAt); err != nil {
+		key, err := scanAPIKey(rows)
+		if err != nil {
 			return nil, fmt.Errorf("error scanning row: %w", err)
 		}
-		keys = append(keys, key)
+		keys = append(keys, *key)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating rows: %w", err)
@@ -100,6 +310,163 @@ func (s *APIKeyService) ListKeys(ctx context.Context) ([]APIKey, error) {
 	return keys, nil
 }
 
+// InsertKeySQL inserts an API key using the parameters from KeyOptions.InsertParams.
+const InsertKeySQL = `
+	INSERT INTO api_keys (
+		prefix, key_hash, salt, description, scopes, expires_at,
+		requests_per_minute, daily_id_quota, daily_queue_quota, created_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+// InsertParams returns the parameters of InsertKeySQL for a key with these options.
+func (o KeyOptions) InsertParams(hashed *HashedKey) []any {
+	return []any{
+		hashed.Prefix, hashed.Hash, hashed.Salt, o.Description, FormatScopes(o.Scopes), nullIfZero(o.ExpiresAt),
+		nullIfZero(o.RequestsPerMinute), nullIfZero(o.DailyIDQuota), nullIfZero(o.DailyQueueQuota), time.Now().Unix(),
+	}
+}
+
+// scanAPIKey scans the APIKeyFields columns into an APIKey, after any extra
+// leading columns.
+func scanAPIKey(row interface{ Scan(dest ...any) error }, extra ...any) (*APIKey, error) {
+	var key APIKey
+	var description sql.NullString
+	var scopes string
+	var expiresAt, lastUsedAt, requestsPerMinute, dailyIDQuota, dailyQueueQuota, replacedBy, rotatedAt sql.NullInt64
+
+	dest := append(extra,
+		&key.ID, &key.Prefix, &description, &scopes, &expiresAt, &key.Disabled, &lastUsedAt,
+		&requestsPerMinute, &dailyIDQuota, &dailyQueueQuota, &replacedBy, &rotatedAt, &key.CreatedAt,
+	)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	key.Description = description.String
+	key.Scopes = strings.Fields(scopes)
+	key.ExpiresAt = expiresAt.Int64
+	key.LastUsedAt = lastUsedAt.Int64
+	key.RequestsPerMinute = requestsPerMinute.Int64
+	key.DailyIDQuota = dailyIDQuota.Int64
+	key.DailyQueueQuota = dailyQueueQuota.Int64
+	key.ReplacedBy = replacedBy.Int64
+	key.RotatedAt = rotatedAt.Int64
+	return &key, nil
+}
+
+// resolveKey returns the ID of the only key matching ref.
+func (s *APIKeyService) resolveKey(ctx context.Context, ref string) (int64, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id FROM api_keys WHERE "+KeyRefCondition,
+		KeyRefParams(ref)...,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error looking up API key: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return 0, fmt.Errorf("error scanning row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	switch len(ids) {
+	case 0:
+		return 0, ErrKeyNotFound
+	case 1:
+		return ids[0], nil
+	default:
+		return 0, ErrAmbiguousKey
+	}
+}
+
+// KeyRefCondition is a SQL condition matching api_keys rows by the reference
+// bound with KeyRefParams.
+const KeyRefCondition = "(prefix = ? OR CAST(id AS TEXT) = ?)"
+
+// KeyRefParams returns the parameters for KeyRefCondition. A reference is a
+// key ID, optionally written as "#ID", a key prefix or a full key.
+func KeyRefParams(ref string) []any {
+	return []any{KeyPrefix(ref), strings.TrimPrefix(ref, "#")}
+}
+
+// ParseScopes parses a comma or space separated list of scopes.
+func ParseScopes(value string) ([]string, error) {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+
+	scopes := make([]string, 0, len(fields))
+	for _, scope := range fields {
+		switch scope {
+		case ScopeLookupRead, ScopeQueueWrite, ScopeQueueProcess, ScopeAdmin:
+			scopes = append(scopes, scope)
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnknownScope, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// nullIfZero returns value as a SQL parameter, or NULL if it is zero.
+func nullIfZero(value int64) any {
+	if value == 0 {
+		return nil
+	}
+	return value
+}
+
+// FormatScopes returns scopes in the space separated form stored in D1.
+func FormatScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// KeyPrefix returns the public prefix that identifies a key.
+func KeyPrefix(key string) string {
+	if len(key) > KeyPrefixLength {
+		return key[:KeyPrefixLength]
+	}
+	return key
+}
+
+// HashKey derives the stored form of key with a new random salt.
+func HashKey(key string) (*HashedKey, error) {
+	if len(key) < MinKeyLength {
+		return nil, ErrKeyTooShort
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("error generating salt: %w", err)
+	}
+
+	hashed := &HashedKey{
+		Prefix: KeyPrefix(key),
+		Salt:   hex.EncodeToString(salt),
+	}
+	hashed.Hash = hashKey(key, hashed.Salt)
+	return hashed, nil
+}
+
+// verifyKey reports whether key matches the stored hash and salt.
+func verifyKey(key, salt, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashKey(key, salt)), []byte(hash)) == 1
+}
+
+// hashKey returns the hex-encoded SHA-256 of salt and key. Keys are random
+// 256-bit secrets, so a fast hash is enough.
+func hashKey(key, salt string) string {
+	sum := sha256.Sum256([]byte(salt + key))
+	return hex.EncodeToString(sum[:])
+}
+
 // GenerateKey generates a secure random API key.
 func GenerateKey() (string, error) {
 	// Generate 32 bytes of random data
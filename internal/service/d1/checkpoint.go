@@ -0,0 +1,188 @@
+package d1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const syncCheckpointsTableSQL = `
+	CREATE TABLE IF NOT EXISTS sync_checkpoints (
+		run_id INTEGER PRIMARY KEY,
+		last_user_id INTEGER NOT NULL,
+		committed_at INTEGER NOT NULL
+	);
+`
+
+var (
+	ErrIncompleteStaging = errors.New("new_flags does not contain every record")
+	ErrNoCheckpoint      = errors.New("no interrupted rebuild to resume")
+)
+
+// checkpoint tracks how far a full rebuild got. Every user up to and including
+// lastUserID was committed to new_flags, so a resumed rebuild only has to write
+// the users after it. Batches are committed concurrently, so the checkpoint
+// only advances once every earlier batch was committed too.
+type checkpoint struct {
+	runID int64
+
+	mu         sync.Mutex
+	lastUserID uint64
+	next       int
+	done       map[int]uint64
+}
+
+// newCheckpoint creates a checkpoint for the given run that starts after lastUserID.
+func newCheckpoint(runID int64, lastUserID uint64) *checkpoint {
+	return &checkpoint{
+		runID:      runID,
+		lastUserID: lastUserID,
+		done:       make(map[int]uint64),
+	}
+}
+
+// complete records that the batch with the given index and last user ID was
+// committed. It reports the new last user ID of the checkpoint and whether it
+// advanced.
+func (cp *checkpoint) complete(batchIndex int, lastUserID uint64) (uint64, bool) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.done[batchIndex] = lastUserID
+
+	advanced := false
+	for {
+		last, ok := cp.done[cp.next]
+		if !ok {
+			return cp.lastUserID, advanced
+		}
+		delete(cp.done, cp.next)
+		cp.lastUserID = last
+		cp.next++
+		advanced = true
+	}
+}
+
+// loadCheckpoint returns the checkpoint of the most recent interrupted rebuild,
+// carried over to the given run, or ErrNoCheckpoint if there is nothing to
+// resume from. Rows written after the checkpoint are removed from new_flags,
+// as batches committed after an uncommitted one may be out of date.
+func (s *SyncService) loadCheckpoint(ctx context.Context, runID int64) (*checkpoint, error) {
+	result, err := s.cfAPI.ExecuteSQL(ctx,
+		"SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'new_flags'",
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error checking new_flags table: %w", err)
+	}
+	if len(result.Rows()) == 0 {
+		return nil, ErrNoCheckpoint
+	}
+
+	result, err = s.cfAPI.ExecuteSQL(ctx,
+		"SELECT run_id, last_user_id FROM sync_checkpoints ORDER BY run_id DESC LIMIT 1",
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error querying checkpoints: %w", err)
+	}
+	rows := result.Rows()
+	if len(rows) == 0 {
+		return nil, ErrNoCheckpoint
+	}
+
+	lastUserID := uint64(rows[0]["last_user_id"].(float64))
+	log.Printf("⏩ Resuming run #%d after user %d", int64(rows[0]["run_id"].(float64)), lastUserID)
+
+	cp := newCheckpoint(runID, lastUserID)
+	if _, err := s.cfAPI.ExecuteSQL(ctx,
+		"DELETE FROM new_flags WHERE user_id > ?",
+		[]any{lastUserID},
+	); err != nil {
+		return nil, fmt.Errorf("error removing uncommitted rows: %w", err)
+	}
+	if err := s.saveCheckpoint(ctx, cp.runID, lastUserID); err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+// saveCheckpoint records that every user up to lastUserID was committed to
+// new_flags by the given run. The checkpoint never moves backwards, even if
+// saves from concurrent batches arrive out of order.
+func (s *SyncService) saveCheckpoint(ctx context.Context, runID int64, lastUserID uint64) error {
+	if _, err := s.cfAPI.ExecuteSQL(ctx, `
+		INSERT INTO sync_checkpoints (run_id, last_user_id, committed_at) VALUES (?, ?, ?)
+		ON CONFLICT (run_id) DO UPDATE SET
+			last_user_id = excluded.last_user_id,
+			committed_at = excluded.committed_at
+		WHERE excluded.last_user_id > sync_checkpoints.last_user_id
+	`, []any{runID, lastUserID, time.Now().Unix()}); err != nil {
+		return fmt.Errorf("error saving checkpoint: %w", err)
+	}
+	return nil
+}
+
+// clearCheckpoints removes all recorded checkpoints.
+func (s *SyncService) clearCheckpoints(ctx context.Context) error {
+	if _, err := s.cfAPI.ExecuteSQL(ctx, "DELETE FROM sync_checkpoints", nil); err != nil {
+		return fmt.Errorf("error clearing checkpoints: %w", err)
+	}
+	return nil
+}
+
+// startRebuild starts a full rebuild from an empty new_flags table, discarding
+// the checkpoints of earlier runs.
+func (s *SyncService) startRebuild(ctx context.Context, runID int64) (*checkpoint, error) {
+	if err := s.clearCheckpoints(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.createStagingTable(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create staging table: %w", err)
+	}
+	return newCheckpoint(runID, 0), nil
+}
+
+// countStaged returns the number of flags per flag type already in new_flags.
+func (s *SyncService) countStaged(ctx context.Context) (flagCounts, error) {
+	result, err := s.cfAPI.ExecuteSQL(ctx,
+		"SELECT flag_type, COUNT(*) AS count FROM new_flags GROUP BY flag_type",
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error counting new_flags rows: %w", err)
+	}
+
+	counts := make(flagCounts)
+	for _, row := range result.Rows() {
+		counts[uint8(row["flag_type"].(float64))] = int64(row["count"].(float64))
+	}
+	return counts, nil
+}
+
+// verifyStagingTable checks that new_flags holds the expected number of rows
+// before it is swapped in. On a mismatch the checkpoints are cleared so the
+// next run starts over instead of resuming from them.
+func (s *SyncService) verifyStagingTable(ctx context.Context, expected int64) error {
+	result, err := s.cfAPI.ExecuteSQL(ctx, "SELECT COUNT(*) AS count FROM new_flags", nil)
+	if err != nil {
+		return fmt.Errorf("error counting new_flags rows: %w", err)
+	}
+
+	var count int64
+	if rows := result.Rows(); len(rows) > 0 {
+		count = int64(rows[0]["count"].(float64))
+	}
+	if count == expected {
+		return nil
+	}
+
+	if err := s.clearCheckpoints(ctx); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: expected %d rows, found %d", ErrIncompleteStaging, expected, count)
+}
@@ -7,44 +7,252 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/rand/v2"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
 	ErrUnexpectedStatusCode = errors.New("unexpected status code")
 	ErrD1APIUnsuccessful    = errors.New("D1 API returned unsuccessful response")
+
+	ErrAuth        = errors.New("D1 API authentication failed")
+	ErrNotFound    = errors.New("D1 API account or database not found")
+	ErrRateLimited = errors.New("D1 API rate limit exceeded")
+	ErrSQL         = errors.New("D1 SQL error")
+	ErrRequest     = errors.New("D1 API rejected the request")
+	ErrServer      = errors.New("D1 API server error")
+	ErrNetwork     = errors.New("D1 API network error")
 )
 
+// ResponseInfo is an entry of the errors or messages array in a Cloudflare API response.
+type ResponseInfo struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// QueryMeta is the metadata D1 reports for a statement.
+type QueryMeta struct {
+	ChangedDB   bool    `json:"changed_db"`
+	Changes     int64   `json:"changes"`
+	Duration    float64 `json:"duration"`
+	LastRowID   int64   `json:"last_row_id"`
+	RowsRead    int64   `json:"rows_read"`
+	RowsWritten int64   `json:"rows_written"`
+	SizeAfter   int64   `json:"size_after"`
+}
+
+// StatementResult is the result of a single statement.
+type StatementResult struct {
+	Results []map[string]any `json:"results"`
+	Success bool             `json:"success"`
+	Meta    QueryMeta        `json:"meta"`
+}
+
 // Response is the response from the D1 API.
 type Response struct {
-	Success bool `json:"success"`
-	Result  []struct {
-		Results []map[string]any `json:"results"`
-	} `json:"result"`
+	Success  bool              `json:"success"`
+	Errors   []ResponseInfo    `json:"errors"`
+	Messages []ResponseInfo    `json:"messages"`
+	Result   []StatementResult `json:"result"`
+}
+
+// QueryResult is the result of an ExecuteSQL call, with one entry per statement.
+type QueryResult struct {
+	Statements []StatementResult
+	Messages   []ResponseInfo
+}
+
+// Rows returns the rows of the first statement.
+func (r *QueryResult) Rows() []map[string]any {
+	if len(r.Statements) == 0 || r.Statements[0].Results == nil {
+		return []map[string]any{}
+	}
+	return r.Statements[0].Results
+}
+
+// TotalMeta returns the metadata of all statements added together.
+// ChangedDB is set if any statement changed the database, and LastRowID and
+// SizeAfter are taken from the last statement.
+func (r *QueryResult) TotalMeta() QueryMeta {
+	var total QueryMeta
+	for _, stmt := range r.Statements {
+		total.ChangedDB = total.ChangedDB || stmt.Meta.ChangedDB
+		total.Changes += stmt.Meta.Changes
+		total.Duration += stmt.Meta.Duration
+		total.RowsRead += stmt.Meta.RowsRead
+		total.RowsWritten += stmt.Meta.RowsWritten
+		total.LastRowID = stmt.Meta.LastRowID
+		total.SizeAfter = stmt.Meta.SizeAfter
+	}
+	return total
+}
+
+// APIError holds the errors reported in an unsuccessful Cloudflare API response.
+type APIError struct {
+	Errors   []ResponseInfo
+	Messages []ResponseInfo
+}
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	if len(e.Errors) == 0 {
+		return ErrD1APIUnsuccessful.Error()
+	}
+
+	msgs := make([]string, len(e.Errors))
+	for i, info := range e.Errors {
+		msgs[i] = fmt.Sprintf("[%d] %s", info.Code, info.Message)
+	}
+	return fmt.Sprintf("%v: %s", ErrD1APIUnsuccessful, strings.Join(msgs, "; "))
+}
+
+// Unwrap allows errors.Is to match ErrD1APIUnsuccessful.
+func (e *APIError) Unwrap() error {
+	return ErrD1APIUnsuccessful
+}
+
+// HasCode reports whether the response contained an error with the given code.
+func (e *APIError) HasCode(code int) bool {
+	for _, info := range e.Errors {
+		if info.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryPolicy configures how failed D1 API requests are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// BaseDelay is the initial backoff delay, doubled after every attempt.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between two attempts, including delays requested
+	// by a Retry-After header.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy returns the retry policy used when none is configured.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    30 * time.Second,
+	}
+}
+
+// backoff returns a jittered delay for the given attempt, starting at 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1) //nolint:gosec // jitter does not need a secure source
+}
+
+// RequestError describes a D1 API request that failed after all retries.
+// Kind is one of ErrAuth, ErrNotFound, ErrRateLimited, ErrSQL, ErrRequest,
+// ErrServer or ErrNetwork.
+type RequestError struct {
+	Kind       error
+	StatusCode int
+	Attempts   int
+	Body       string
+	Err        error
+}
+
+// Error implements the error interface.
+func (e *RequestError) Error() string {
+	msg := fmt.Sprintf("%v after %d attempt(s)", e.Kind, e.Attempts)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(": %d", e.StatusCode)
+	}
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap allows errors.Is to match the error kind and the underlying error.
+func (e *RequestError) Unwrap() []error {
+	errs := []error{e.Kind}
+	if e.StatusCode != 0 && e.StatusCode != http.StatusOK {
+		errs = append(errs, ErrUnexpectedStatusCode)
+	}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// DefaultBaseURL is the base URL of the Cloudflare API.
+const DefaultBaseURL = "https://api.cloudflare.com/client/v4"
+
+// Option configures a CloudflareAPI client.
+type Option func(*CloudflareAPI)
+
+// WithBaseURL sets the base URL of the Cloudflare API, for example to point
+// the client at a local D1 stand-in.
+func WithBaseURL(baseURL string) Option {
+	return func(c *CloudflareAPI) {
+		c.baseURL = strings.TrimRight(baseURL, "/")
+	}
+}
+
+// WithRetryPolicy sets the retry policy used by ExecuteSQL.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *CloudflareAPI) {
+		c.retry = policy
+	}
 }
 
 // CloudflareAPI handles D1 API requests.
 type CloudflareAPI struct {
+	baseURL   string
 	accountID string
 	d1ID      string
 	token     string
 	client    *http.Client
+	retry     RetryPolicy
 }
 
 // NewCloudflareAPI creates a new Cloudflare API client.
-func NewCloudflareAPI(accountID, d1ID, token string) *CloudflareAPI {
-	return &CloudflareAPI{
+func NewCloudflareAPI(accountID, d1ID, token string, opts ...Option) *CloudflareAPI {
+	c := &CloudflareAPI{
+		baseURL:   DefaultBaseURL,
 		accountID: accountID,
 		d1ID:      d1ID,
 		token:     token,
 		client:    &http.Client{},
+		retry:     DefaultRetryPolicy(),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
 
-// ExecuteSQL executes a SQL statement on D1 and returns the results.
-func (c *CloudflareAPI) ExecuteSQL(ctx context.Context, sql string, params []any) ([]map[string]any, error) {
+// ExecuteSQL executes one or more SQL statements on D1 and returns the
+// results and metadata of every statement.
+//
+// Rate limited requests are always retried since D1 rejects them before
+// running any SQL. Server and network errors are only retried when every
+// statement is safe to run twice.
+func (c *CloudflareAPI) ExecuteSQL(ctx context.Context, sql string, params []any) (*QueryResult, error) {
 	url := fmt.Sprintf(
-		"https://api.cloudflare.com/client/v4/accounts/%s/d1/database/%s/query",
+		"%s/accounts/%s/d1/database/%s/query",
+		c.baseURL,
 		c.accountID,
 		c.d1ID,
 	)
@@ -60,10 +268,46 @@ func (c *CloudflareAPI) ExecuteSQL(ctx context.Context, sql string, params []any
 		return nil, fmt.Errorf("error marshaling request: %w", err)
 	}
 
+	idempotent := isIdempotent(sql)
+	maxAttempts := max(c.retry.MaxAttempts, 1)
+
+	for attempt := 1; ; attempt++ {
+		result, retryAfter, reqErr := c.doRequest(ctx, url, jsonBody)
+		if reqErr == nil {
+			return result, nil
+		}
+		reqErr.Attempts = attempt
+
+		retryable := errors.Is(reqErr.Kind, ErrRateLimited) ||
+			(idempotent && (errors.Is(reqErr.Kind, ErrServer) || errors.Is(reqErr.Kind, ErrNetwork)))
+		if !retryable || attempt >= maxAttempts || ctx.Err() != nil {
+			return nil, reqErr
+		}
+
+		// Honor Retry-After, but never wait longer than the policy allows
+		delay := c.retry.backoff(attempt)
+		if retryAfter > 0 {
+			delay = min(retryAfter, c.retry.MaxDelay)
+		}
+		log.Printf("⏳ D1 request failed (%v), retrying in %v (attempt %d/%d)", reqErr.Kind, delay, attempt, maxAttempts)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// doRequest performs a single D1 API request. On failure it returns the
+// classified error and the delay requested by a Retry-After header, if any.
+func (c *CloudflareAPI) doRequest(
+	ctx context.Context, url string, jsonBody []byte,
+) (*QueryResult, time.Duration, *RequestError) {
 	// Create request
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonBody))
 	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
+		return nil, 0, &RequestError{Kind: ErrNetwork, Err: fmt.Errorf("error creating request: %w", err)}
 	}
 
 	req.Header.Set("Authorization", "Bearer "+c.token)
@@ -72,29 +316,136 @@ func (c *CloudflareAPI) ExecuteSQL(ctx context.Context, sql string, params []any
 	// Execute request
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error executing request: %w", err)
+		return nil, 0, &RequestError{Kind: ErrNetwork, Err: fmt.Errorf("error executing request: %w", err)}
 	}
 	defer resp.Body.Close()
 
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, &RequestError{Kind: ErrNetwork, Err: fmt.Errorf("error reading response: %w", err)}
+	}
+
+	// Parse response, which uses the same envelope for errors
+	var d1Resp Response
+	decodeErr := json.Unmarshal(body, &d1Resp)
+
 	// Check response
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("%w: %d: %s", ErrUnexpectedStatusCode, resp.StatusCode, string(body))
+		reqErr := &RequestError{
+			Kind:       classifyStatus(resp.StatusCode),
+			StatusCode: resp.StatusCode,
+		}
+		if decodeErr == nil && len(d1Resp.Errors) > 0 {
+			reqErr.Err = &APIError{Errors: d1Resp.Errors, Messages: d1Resp.Messages}
+		} else {
+			reqErr.Body = string(body)
+		}
+		return nil, parseRetryAfter(resp.Header.Get("Retry-After")), reqErr
 	}
 
-	// Parse response
-	var d1Resp Response
-	if err := json.NewDecoder(resp.Body).Decode(&d1Resp); err != nil {
-		return nil, fmt.Errorf("error decoding response: %w", err)
+	if decodeErr != nil {
+		return nil, 0, &RequestError{
+			Kind:       ErrServer,
+			StatusCode: resp.StatusCode,
+			Err:        fmt.Errorf("error decoding response: %w", decodeErr),
+		}
 	}
 
 	if !d1Resp.Success {
-		return nil, ErrD1APIUnsuccessful
+		return nil, 0, &RequestError{
+			Kind:       ErrSQL,
+			StatusCode: resp.StatusCode,
+			Err:        &APIError{Errors: d1Resp.Errors, Messages: d1Resp.Messages},
+		}
 	}
 
-	if len(d1Resp.Result) == 0 || len(d1Resp.Result[0].Results) == 0 {
-		return []map[string]any{}, nil
+	return &QueryResult{
+		Statements: d1Resp.Result,
+		Messages:   d1Resp.Messages,
+	}, 0, nil
+}
+
+// classifyStatus maps a non-200 HTTP status code to an error kind. D1 reports
+// failed statements with 400 Bad Request.
+func classifyStatus(statusCode int) error {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrAuth
+	case statusCode == http.StatusNotFound:
+		return ErrNotFound
+	case statusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case statusCode == http.StatusBadRequest:
+		return ErrSQL
+	case statusCode >= http.StatusInternalServerError:
+		return ErrServer
+	default:
+		return ErrRequest
 	}
+}
 
-	return d1Resp.Result[0].Results, nil
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// idempotentPrefixes lists statement prefixes that are safe to run more than once.
+var idempotentPrefixes = []string{
+	"SELECT",
+	"PRAGMA",
+	"DELETE",
+	"INSERT OR REPLACE",
+	"INSERT OR IGNORE",
+	"CREATE TABLE IF NOT EXISTS",
+	"CREATE INDEX IF NOT EXISTS",
+	"CREATE TRIGGER IF NOT EXISTS",
+	"DROP TABLE IF EXISTS",
+	"DROP INDEX IF EXISTS",
+}
+
+// isIdempotent reports whether every statement in sql can safely be retried.
+// Upserts are treated as idempotent as long as their conflict clause does not
+// do arithmetic, since they then converge to the same row.
+func isIdempotent(sql string) bool {
+	for _, stmt := range strings.Split(stripComments(sql), ";") {
+		stmt = strings.ToUpper(strings.Join(strings.Fields(stmt), " "))
+		if stmt == "" {
+			continue
+		}
+
+		safe := false
+		if idx := strings.Index(stmt, "ON CONFLICT"); idx >= 0 && strings.HasPrefix(stmt, "INSERT") {
+			safe = !strings.ContainsAny(stmt[idx:], "+-")
+		}
+		for _, prefix := range idempotentPrefixes {
+			if strings.HasPrefix(stmt, prefix) {
+				safe = true
+				break
+			}
+		}
+		if !safe {
+			return false
+		}
+	}
+	return true
+}
+
+// stripComments removes "--" line comments from sql.
+func stripComments(sql string) string {
+	lines := strings.Split(sql, "\n")
+	for i, line := range lines {
+		if idx := strings.Index(line, "--"); idx >= 0 {
+			lines[i] = line[:idx]
+		}
+	}
+	return strings.Join(lines, "\n")
 }
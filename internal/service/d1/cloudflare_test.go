@@ -0,0 +1,94 @@
+package d1
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIsIdempotent(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want bool
+	}{
+		{"select", "SELECT * FROM user_flags WHERE user_id = ?", true},
+		{"lowercase with whitespace", "\n\t  select 1", true},
+		{"delete", "DELETE FROM user_flags WHERE user_id IN (?, ?)", true},
+		{"insert or replace", "INSERT OR REPLACE INTO user_flags VALUES (?, ?, ?, ?)", true},
+		{"create if not exists", "CREATE TABLE IF NOT EXISTS t (id INTEGER)", true},
+		{"plain insert", "INSERT INTO api_keys (prefix) VALUES (?)", false},
+		{"update", "UPDATE api_keys SET disabled = 1 WHERE id = ?", false},
+		{"create without if not exists", "CREATE TABLE t (id INTEGER)", false},
+		{"alter table", "ALTER TABLE user_flags RENAME TO flags_snapshot_1", false},
+		{
+			"upsert that overwrites",
+			"INSERT INTO sync_checkpoints (run_id) VALUES (?) ON CONFLICT DO UPDATE SET committed_at = excluded.committed_at",
+			true,
+		},
+		{
+			"upsert that counts",
+			"INSERT INTO rate_limit_counters (count) VALUES (?) ON CONFLICT DO UPDATE SET count = count + excluded.count",
+			false,
+		},
+		{"all safe statements", "DROP TABLE IF EXISTS new_flags; SELECT 1;", true},
+		{"one unsafe statement", "DELETE FROM new_flags; UPDATE dataset_meta SET version = version + 1", false},
+		{"unsafe statement in comment", "-- UPDATE dataset_meta\nSELECT 1", true},
+		{"empty", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isIdempotent(tt.sql); got != tt.want {
+				t.Errorf("isIdempotent(%q) = %v, want %v", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"empty", "", 0, 0},
+		{"seconds", "30", 30 * time.Second, 30 * time.Second},
+		{"zero seconds", "0", 0, 0},
+		{"negative seconds", "-5", 0, 0},
+		{"invalid", "soon", 0, 0},
+		{"future date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 55 * time.Second, time.Minute},
+		{"past date", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %v, want between %v and %v", tt.value, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestClassifyStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   error
+	}{
+		{http.StatusBadRequest, ErrSQL},
+		{http.StatusUnauthorized, ErrAuth},
+		{http.StatusForbidden, ErrAuth},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusConflict, ErrRequest},
+		{http.StatusTooManyRequests, ErrRateLimited},
+		{http.StatusInternalServerError, ErrServer},
+		{http.StatusBadGateway, ErrServer},
+	}
+
+	for _, tt := range tests {
+		if got := classifyStatus(tt.status); got != tt.want {
+			t.Errorf("classifyStatus(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
@@ -75,7 +75,8 @@ func (s *FlagService) GetUserFlags(ctx context.Context, ids []uint64) (map[uint6
 
 	// Build query for queued_users table
 	queryBuilder.Reset()
-	queryBuilder.WriteString("SELECT user_id FROM queued_users WHERE processed = 1 AND flagged = 1 AND user_id IN (")
+	queryBuilder.WriteString("SELECT user_id, confidence, reasons FROM queued_users ")
+	queryBuilder.WriteString("WHERE processed = 1 AND flagged = 1 AND user_id IN (")
 	for i := range ids {
 		if i > 0 {
 			queryBuilder.WriteString(",")
@@ -94,12 +95,19 @@ func (s *FlagService) GetUserFlags(ctx context.Context, ids []uint64) (map[uint6
 	// Add queued users that aren't already in flags map
 	for queueRows.Next() {
 		var id uint64
-		if err := queueRows.Scan(&id); err != nil {
+		var confidence sql.NullFloat64
+		var reasons sql.NullString
+		if err := queueRows.Scan(&id, &confidence, &reasons); err != nil {
 			return nil, fmt.Errorf("error scanning queue row: %w", err)
 		}
 		// Only add if not already in flags map
 		if _, exists := flags[id]; !exists {
-			flags[id] = FlagResponse{Flag: 3}
+			flag := FlagResponse{Flag: 3, Reasons: reasons}
+			if confidence.Valid {
+				value := float32(confidence.Float64)
+				flag.Confidence = &value
+			}
+			flags[id] = flag
 		}
 	}
 	if err := queueRows.Err(); err != nil {
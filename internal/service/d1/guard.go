@@ -0,0 +1,81 @@
+package d1
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// DefaultMaxDropPercent is the largest drop in flags allowed without forcing a sync.
+const DefaultMaxDropPercent = 10.0
+
+var ErrSuspiciousDrop = errors.New("new dataset is suspiciously small")
+
+// flagCounts holds the number of flags per flag type.
+type flagCounts map[uint8]int64
+
+// total returns the number of flags across all flag types.
+func (c flagCounts) total() int64 {
+	var total int64
+	for _, count := range c {
+		total += count
+	}
+	return total
+}
+
+// add adds the counts of other to c.
+func (c flagCounts) add(other flagCounts) {
+	for flagType, count := range other {
+		c[flagType] += count
+	}
+}
+
+// countRecords returns the number of unique users per flag type in records.
+func countRecords(records []Record) flagCounts {
+	types := make(map[uint64]uint8, len(records))
+	for _, rec := range records {
+		types[rec.userID] = rec.flagType
+	}
+
+	counts := make(flagCounts)
+	for _, flagType := range types {
+		counts[flagType]++
+	}
+	return counts
+}
+
+// checkDrop compares the new flag counts against the live ones and refuses
+// to continue if the total or any flag type shrinks by more than
+// maxDropPercent, unless force is set.
+func checkDrop(live, next flagCounts, maxDropPercent float64, force bool) error {
+	var problems []string
+	if drop := dropPercent(live.total(), next.total()); drop > maxDropPercent {
+		problems = append(problems, fmt.Sprintf("total %d -> %d (-%.1f%%)", live.total(), next.total(), drop))
+	}
+	for flagType, count := range live {
+		if drop := dropPercent(count, next[flagType]); drop > maxDropPercent {
+			problems = append(problems, fmt.Sprintf("type %d %d -> %d (-%.1f%%)", flagType, count, next[flagType], drop))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	summary := strings.Join(problems, ", ")
+	if force {
+		log.Printf("⚠️ Flag count dropped beyond %.1f%% (%s), continuing because of --force", maxDropPercent, summary)
+		return nil
+	}
+	return fmt.Errorf("%w: %s exceeds the %.1f%% limit (use --force to sync anyway)",
+		ErrSuspiciousDrop, summary, maxDropPercent)
+}
+
+// dropPercent returns how much smaller next is than live, in percent.
+func dropPercent(live, next int64) float64 {
+	if live == 0 || next >= live {
+		return 0
+	}
+	return float64(live-next) / float64(live) * 100
+}
@@ -0,0 +1,39 @@
+package d1
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckDrop(t *testing.T) {
+	tests := []struct {
+		name    string
+		live    flagCounts
+		next    flagCounts
+		max     float64
+		force   bool
+		wantErr bool
+	}{
+		{"first sync", flagCounts{}, flagCounts{1: 100}, 10, false, false},
+		{"growth", flagCounts{1: 100, 2: 10}, flagCounts{1: 150, 2: 20}, 10, false, false},
+		{"drop within limit", flagCounts{1: 100}, flagCounts{1: 90}, 10, false, false},
+		{"drop over limit", flagCounts{1: 100}, flagCounts{1: 89}, 10, false, true},
+		{"drop over limit with force", flagCounts{1: 100}, flagCounts{1: 10}, 10, true, false},
+		{"empty dataset", flagCounts{1: 100, 2: 10}, flagCounts{}, 10, false, true},
+		{"one type drops", flagCounts{1: 1000, 2: 10}, flagCounts{1: 1000, 2: 5}, 10, false, true},
+		{"zero limit rejects any drop", flagCounts{1: 100}, flagCounts{1: 99}, 0, false, true},
+		{"full limit allows any drop", flagCounts{1: 100}, flagCounts{}, 100, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDrop(tt.live, tt.next, tt.max, tt.force)
+			if tt.wantErr && !errors.Is(err, ErrSuspiciousDrop) {
+				t.Errorf("checkDrop() = %v, want %v", err, ErrSuspiciousDrop)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("checkDrop() = %v, want nil", err)
+			}
+		})
+	}
+}
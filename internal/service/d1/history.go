@@ -0,0 +1,143 @@
+package d1
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const syncRunsTableSQL = `
+	CREATE TABLE IF NOT EXISTS sync_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		started_at INTEGER NOT NULL,
+		finished_at INTEGER,
+		mode TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		error TEXT,
+		total_count INTEGER NOT NULL DEFAULT 0,
+		flagged_count INTEGER NOT NULL DEFAULT 0,
+		confirmed_count INTEGER NOT NULL DEFAULT 0,
+		rows_written INTEGER NOT NULL DEFAULT 0,
+		source_host TEXT,
+		cli_version TEXT
+	);
+`
+
+// Sync run outcomes.
+const (
+	SyncOutcomeRunning = "running"
+	SyncOutcomeSuccess = "success"
+	SyncOutcomeSkipped = "skipped"
+	SyncOutcomeFailed  = "failed"
+)
+
+// SyncRun represents a recorded sync run.
+type SyncRun struct {
+	ID             int64
+	StartedAt      int64
+	FinishedAt     int64
+	Mode           string
+	Outcome        string
+	Error          string
+	TotalCount     int64
+	FlaggedCount   int64
+	ConfirmedCount int64
+	RowsWritten    int64
+	SourceHost     string
+	CLIVersion     string
+}
+
+// Duration returns how long the run took, or zero if it hasn't finished.
+func (r *SyncRun) Duration() time.Duration {
+	if r.FinishedAt == 0 {
+		return 0
+	}
+	return time.Duration(r.FinishedAt-r.StartedAt) * time.Second
+}
+
+// SyncHistoryService records sync runs in D1.
+type SyncHistoryService struct {
+	cfAPI *CloudflareAPI
+}
+
+// NewSyncHistoryService creates a new sync history service.
+func NewSyncHistoryService(cfAPI *CloudflareAPI) *SyncHistoryService {
+	return &SyncHistoryService{
+		cfAPI: cfAPI,
+	}
+}
+
+// StartRun records the start of a sync run and sets its ID.
+func (s *SyncHistoryService) StartRun(ctx context.Context, run *SyncRun) error {
+	run.StartedAt = time.Now().Unix()
+	run.Outcome = SyncOutcomeRunning
+
+	result, err := s.cfAPI.ExecuteSQL(ctx, `
+		INSERT INTO sync_runs (started_at, mode, outcome, source_host, cli_version)
+		VALUES (?, ?, ?, ?, ?)
+	`, []any{run.StartedAt, run.Mode, run.Outcome, run.SourceHost, run.CLIVersion})
+	if err != nil {
+		return fmt.Errorf("error recording sync run: %w", err)
+	}
+
+	run.ID = result.TotalMeta().LastRowID
+	return nil
+}
+
+// FinishRun records the outcome of a sync run.
+func (s *SyncHistoryService) FinishRun(ctx context.Context, run *SyncRun) error {
+	run.FinishedAt = time.Now().Unix()
+
+	if _, err := s.cfAPI.ExecuteSQL(ctx, `
+		UPDATE sync_runs SET
+			finished_at = ?, outcome = ?, error = ?, total_count = ?,
+			flagged_count = ?, confirmed_count = ?, rows_written = ?
+		WHERE id = ?
+	`, []any{
+		run.FinishedAt, run.Outcome, run.Error, run.TotalCount,
+		run.FlaggedCount, run.ConfirmedCount, run.RowsWritten, run.ID,
+	}); err != nil {
+		return fmt.Errorf("error updating sync run: %w", err)
+	}
+	return nil
+}
+
+// ListRuns returns the most recent sync runs, newest first.
+func (s *SyncHistoryService) ListRuns(ctx context.Context, limit int) ([]SyncRun, error) {
+	if _, err := s.cfAPI.ExecuteSQL(ctx, syncRunsTableSQL, nil); err != nil {
+		return nil, fmt.Errorf("error creating sync runs table: %w", err)
+	}
+
+	result, err := s.cfAPI.ExecuteSQL(ctx, `
+		SELECT id, started_at, finished_at, mode, outcome, error, total_count, flagged_count,
+			confirmed_count, rows_written, source_host, cli_version
+		FROM sync_runs ORDER BY id DESC LIMIT ?
+	`, []any{limit})
+	if err != nil {
+		return nil, fmt.Errorf("error querying sync runs: %w", err)
+	}
+
+	rows := result.Rows()
+	runs := make([]SyncRun, 0, len(rows))
+	for _, row := range rows {
+		run := SyncRun{
+			ID:             int64(row["id"].(float64)),
+			StartedAt:      int64(row["started_at"].(float64)),
+			Mode:           row["mode"].(string),
+			Outcome:        row["outcome"].(string),
+			TotalCount:     int64(row["total_count"].(float64)),
+			FlaggedCount:   int64(row["flagged_count"].(float64)),
+			ConfirmedCount: int64(row["confirmed_count"].(float64)),
+			RowsWritten:    int64(row["rows_written"].(float64)),
+		}
+		if finishedAt, ok := row["finished_at"].(float64); ok {
+			run.FinishedAt = int64(finishedAt)
+		}
+		run.Error, _ = row["error"].(string)
+		run.SourceHost, _ = row["source_host"].(string)
+		run.CLIVersion, _ = row["cli_version"].(string)
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
@@ -0,0 +1,171 @@
+package d1
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// apiKeyStateSQL creates the version counter of the api_keys table and the
+// triggers that bump it whenever a change affects which keys are valid.
+// Recording the last use of a key doesn't count as a change. Columns added to
+// api_keys that affect validation must be added to the update trigger, which
+// is recreated every time so existing databases pick up the change.
+const apiKeyStateSQL = `
+	CREATE TABLE IF NOT EXISTS api_key_state (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		version INTEGER NOT NULL
+	);
+	INSERT OR IGNORE INTO api_key_state (id, version) VALUES (1, 0);
+
+	CREATE TRIGGER IF NOT EXISTS api_keys_insert_version AFTER INSERT ON api_keys
+	BEGIN
+		UPDATE api_key_state SET version = version + 1 WHERE id = 1;
+	END;
+
+	DROP TRIGGER IF EXISTS api_keys_update_version;
+	CREATE TRIGGER api_keys_update_version AFTER UPDATE OF
+		prefix, key_hash, salt, scopes, expires_at, disabled,
+		requests_per_minute, daily_id_quota, daily_queue_quota, replaced_by, rotated_at
+	ON api_keys
+	BEGIN
+		UPDATE api_key_state SET version = version + 1 WHERE id = 1;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS api_keys_delete_version AFTER DELETE ON api_keys
+	BEGIN
+		UPDATE api_key_state SET version = version + 1 WHERE id = 1;
+	END;
+`
+
+const (
+	// keyCacheTTL and keyCacheNegativeTTL are how long known and unknown keys
+	// are cached. They bound how long a change goes unnoticed if the version
+	// counter can't be read.
+	keyCacheTTL         = time.Minute
+	keyCacheNegativeTTL = 10 * time.Second
+
+	// keyVersionCheckInterval is how often the version counter is read, and
+	// so how long a revoked key may keep working in an isolate.
+	keyVersionCheckInterval = 5 * time.Second
+
+	// keyCacheMaxEntries bounds the memory used by the cache, which would
+	// otherwise grow with every invalid key tried.
+	keyCacheMaxEntries = 1000
+)
+
+// keyCacheEntry is a cached authentication result. The key is nil if no key
+// matched.
+type keyCacheEntry struct {
+	key     *APIKey
+	expires time.Time
+}
+
+// keyCache caches API key records in memory by the SHA-256 of the key, so
+// the keys themselves aren't kept. It is emptied whenever the version counter
+// in D1 changes.
+type keyCache struct {
+	mu        sync.Mutex
+	entries   map[[sha256.Size]byte]keyCacheEntry
+	version   int64
+	checkedAt time.Time
+}
+
+// newKeyCache creates an empty key cache.
+func newKeyCache() *keyCache {
+	return &keyCache{
+		entries: make(map[[sha256.Size]byte]keyCacheEntry),
+	}
+}
+
+// get returns a copy of the cached record of key. It reports whether a result
+// was cached, with a nil record meaning no key matched.
+func (c *keyCache) get(key string, now time.Time) (*APIKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[sha256.Sum256([]byte(key))]
+	if !ok || !now.Before(entry.expires) {
+		return nil, false
+	}
+	if entry.key == nil {
+		return nil, true
+	}
+	record := *entry.key
+	return &record, true
+}
+
+// put caches the record of key, or nil if no key matched.
+func (c *keyCache) put(key string, record *APIKey, now time.Time) {
+	entry := keyCacheEntry{expires: now.Add(keyCacheNegativeTTL)}
+	if record != nil {
+		copied := *record
+		entry.key = &copied
+		entry.expires = now.Add(keyCacheTTL)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= keyCacheMaxEntries {
+		for hash, cached := range c.entries {
+			if !now.Before(cached.expires) {
+				delete(c.entries, hash)
+			}
+		}
+		if len(c.entries) >= keyCacheMaxEntries {
+			clear(c.entries)
+		}
+	}
+	c.entries[sha256.Sum256([]byte(key))] = entry
+}
+
+// touch updates the last-used time of a cached key.
+func (c *keyCache) touch(id, lastUsedAt int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range c.entries {
+		if entry.key != nil && entry.key.ID == id {
+			entry.key.LastUsedAt = lastUsedAt
+		}
+	}
+}
+
+// reset empties the cache.
+func (c *keyCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.entries)
+}
+
+// checkVersion empties the cache if the version counter changed since it was
+// last read. The counter is read at most once per keyVersionCheckInterval, and
+// the cache is also emptied if it can't be read.
+func (c *keyCache) checkVersion(ctx context.Context, db *sql.DB, now time.Time) {
+	c.mu.Lock()
+	due := now.Sub(c.checkedAt) >= keyVersionCheckInterval
+	c.mu.Unlock()
+	if !due {
+		return
+	}
+
+	var version int64
+	err := db.QueryRowContext(ctx, "SELECT version FROM api_key_state WHERE id = 1").Scan(&version)
+	if err != nil {
+		log.Printf("Failed to read API key version: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checkedAt = now
+	if err != nil || version != c.version {
+		clear(c.entries)
+		c.version = version
+	}
+}
@@ -0,0 +1,65 @@
+//go:build !js || !wasm
+
+package d1
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestKeyCacheCheckVersion(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+
+	tests := []struct {
+		name      string
+		version   int64
+		dropTable bool
+		elapsed   time.Duration
+		wantKept  bool
+	}{
+		{"unchanged", 3, false, keyVersionCheckInterval, true},
+		{"changed", 4, false, keyVersionCheckInterval, false},
+		{"changed but not due", 4, false, keyVersionCheckInterval - time.Second, true},
+		{"unreadable", 3, true, keyVersionCheckInterval, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, err := sql.Open("sqlite", ":memory:")
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+			db.SetMaxOpenConns(1)
+			defer db.Close()
+
+			exec := func(query string, args ...any) {
+				if _, err := db.Exec(query, args...); err != nil {
+					t.Fatalf("failed to run %q: %v", query, err)
+				}
+			}
+			exec(`CREATE TABLE api_key_state (id INTEGER PRIMARY KEY, version INTEGER NOT NULL)`)
+			exec(`INSERT INTO api_key_state (id, version) VALUES (1, 3)`)
+
+			cache := newKeyCache()
+			cache.checkVersion(ctx, db, start)
+			cache.put("key", &APIKey{ID: 1}, start)
+
+			if tt.dropTable {
+				exec(`DROP TABLE api_key_state`)
+			} else {
+				exec(`UPDATE api_key_state SET version = ?`, tt.version)
+			}
+
+			now := start.Add(tt.elapsed)
+			cache.checkVersion(ctx, db, now)
+			if _, kept := cache.get("key", now); kept != tt.wantKept {
+				t.Errorf("key cached = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
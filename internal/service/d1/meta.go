@@ -0,0 +1,86 @@
+package d1
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const datasetMetaTableSQL = `
+	CREATE TABLE IF NOT EXISTS dataset_meta (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		version INTEGER NOT NULL,
+		synced_at INTEGER,
+		flagged_count INTEGER NOT NULL,
+		confirmed_count INTEGER NOT NULL
+	);
+`
+
+// DatasetMeta describes the flag dataset currently published in D1.
+type DatasetMeta struct {
+	Version        int64
+	SyncedAt       sql.NullInt64
+	FlaggedCount   int64
+	ConfirmedCount int64
+}
+
+// MetaService handles dataset metadata operations in D1.
+type MetaService struct {
+	db *sql.DB
+}
+
+// NewMetaService creates a new metadata service.
+func NewMetaService(db *sql.DB) *MetaService {
+	return &MetaService{
+		db: db,
+	}
+}
+
+// GetDatasetMeta returns the metadata of the published dataset. If no sync
+// has completed yet, it returns empty metadata.
+func (s *MetaService) GetDatasetMeta(ctx context.Context) (*DatasetMeta, error) {
+	var meta DatasetMeta
+	err := s.db.QueryRowContext(ctx,
+		"SELECT version, synced_at, flagged_count, confirmed_count FROM dataset_meta WHERE id = 1",
+	).Scan(&meta.Version, &meta.SyncedAt, &meta.FlaggedCount, &meta.ConfirmedCount)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error querying dataset metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+// InitMetaTable ensures the dataset metadata table exists.
+func (s *MetaService) InitMetaTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, datasetMetaTableSQL)
+	return err
+}
+
+// publishDatasetMeta records that a dataset with the given counts was published.
+// The version is only bumped if the dataset changed, while synced is set
+// whenever the dataset was confirmed to match the source database.
+func publishDatasetMeta(ctx context.Context, cfAPI *CloudflareAPI, counts flagCounts, changed, synced bool) error {
+	var syncedAt any
+	if synced {
+		syncedAt = time.Now().Unix()
+	}
+
+	bump := 0
+	if changed {
+		bump = 1
+	}
+
+	if _, err := cfAPI.ExecuteSQL(ctx, `
+		INSERT INTO dataset_meta (id, version, synced_at, flagged_count, confirmed_count)
+		VALUES (1, 1, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			version = version + ?,
+			synced_at = COALESCE(excluded.synced_at, synced_at),
+			flagged_count = excluded.flagged_count,
+			confirmed_count = excluded.confirmed_count
+	`, []any{syncedAt, counts[1], counts[2], bump}); err != nil {
+		return fmt.Errorf("error updating dataset metadata: %w", err)
+	}
+	return nil
+}
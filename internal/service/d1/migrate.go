@@ -0,0 +1,175 @@
+package d1
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// keyMigrationBatchSize is the number of keys copied per statement, each
+// binding five parameters.
+const keyMigrationBatchSize = maxBoundParams / 5
+
+var ErrShortPlaintextKeys = fmt.Errorf("API keys shorter than %d characters can't be hashed", MinKeyLength)
+
+// MigrationService brings an existing D1 database up to the current schema.
+type MigrationService struct {
+	cfAPI *CloudflareAPI
+}
+
+// NewMigrationService creates a new migration service.
+func NewMigrationService(cfAPI *CloudflareAPI) *MigrationService {
+	return &MigrationService{
+		cfAPI: cfAPI,
+	}
+}
+
+// Migrate upgrades tables created by older versions and creates any that are
+// missing. Plaintext API keys too short to hash stop the migration unless
+// dropShortKeys is set, in which case they are removed.
+func (s *MigrationService) Migrate(ctx context.Context, dropShortKeys bool) error {
+	if err := s.migrateAPIKeys(ctx, dropShortKeys); err != nil {
+		return err
+	}
+
+	if _, err := s.cfAPI.ExecuteSQL(ctx, cliSchemaSQL, nil); err != nil {
+		return fmt.Errorf("error creating tables: %w", err)
+	}
+
+	if err := s.addColumns(ctx, apiKeyColumns); err != nil {
+		return err
+	}
+
+	// The triggers need every api_keys column, so they come last
+	if _, err := s.cfAPI.ExecuteSQL(ctx, apiKeyStateSQL, nil); err != nil {
+		return fmt.Errorf("error creating API key version triggers: %w", err)
+	}
+	return nil
+}
+
+// addColumns adds the given columns to tables that don't have them yet.
+func (s *MigrationService) addColumns(ctx context.Context, columns []addedColumn) error {
+	existing := make(map[string]map[string]bool)
+	for _, column := range columns {
+		if existing[column.table] == nil {
+			names, err := tableColumns(ctx, s.cfAPI, column.table)
+			if err != nil {
+				return err
+			}
+			existing[column.table] = names
+		}
+		if existing[column.table][column.name] {
+			continue
+		}
+
+		log.Printf("➕ Adding column %s.%s", column.table, column.name)
+		if _, err := s.cfAPI.ExecuteSQL(ctx, fmt.Sprintf(
+			"ALTER TABLE %s ADD COLUMN %s %s", column.table, column.name, column.definition,
+		), nil); err != nil {
+			return fmt.Errorf("error adding column %s.%s: %w", column.table, column.name, err)
+		}
+	}
+	return nil
+}
+
+// migrateAPIKeys replaces an api_keys table holding plaintext keys with one
+// holding salted hashes. The new table is filled first and swapped in with a
+// single request, so an interrupted migration leaves the old table in place.
+func (s *MigrationService) migrateAPIKeys(ctx context.Context, dropShortKeys bool) error {
+	columns, err := tableColumns(ctx, s.cfAPI, "api_keys")
+	if err != nil {
+		return err
+	}
+	if !columns["key"] {
+		return nil
+	}
+
+	result, err := s.cfAPI.ExecuteSQL(ctx, "SELECT key, description, created_at FROM api_keys", nil)
+	if err != nil {
+		return fmt.Errorf("error reading plaintext API keys: %w", err)
+	}
+
+	// Keys too short to hash would be rejected anyway, so they are only
+	// dropped if the operator agreed to it
+	var rows []map[string]any
+	var short []string
+	for _, row := range result.Rows() {
+		if len(row["key"].(string)) >= MinKeyLength {
+			rows = append(rows, row)
+			continue
+		}
+
+		description, _ := row["description"].(string)
+		created := time.Unix(int64(row["created_at"].(float64)), 0).Format("2006-01-02 15:04:05")
+		short = append(short, fmt.Sprintf("%q (created %s)", description, created))
+	}
+	if len(short) > 0 {
+		if !dropShortKeys {
+			return fmt.Errorf("%w: %s (migrate with --drop-short-keys to remove them)",
+				ErrShortPlaintextKeys, strings.Join(short, ", "))
+		}
+		for _, key := range short {
+			log.Printf("⚠️ Dropping API key %s: shorter than %d characters", key, MinKeyLength)
+		}
+	}
+	log.Printf("🔑 Hashing %d plaintext API keys...", len(rows))
+
+	createSQL := strings.Replace(apiKeysTableSQL, "IF NOT EXISTS api_keys", "api_keys_hashed", 1)
+	if _, err := s.cfAPI.ExecuteSQL(ctx, "DROP TABLE IF EXISTS api_keys_hashed;"+createSQL, nil); err != nil {
+		return fmt.Errorf("error creating hashed API keys table: %w", err)
+	}
+
+	for i := 0; i < len(rows); i += keyMigrationBatchSize {
+		end := i + keyMigrationBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var query strings.Builder
+		query.WriteString("INSERT INTO api_keys_hashed (prefix, key_hash, salt, description, created_at) VALUES ")
+		params := make([]any, 0, (end-i)*5)
+		for j, row := range rows[i:end] {
+			hashed, err := HashKey(row["key"].(string))
+			if err != nil {
+				return fmt.Errorf("error hashing API key: %w", err)
+			}
+
+			if j > 0 {
+				query.WriteString(",")
+			}
+			query.WriteString("(?, ?, ?, ?, ?)")
+			params = append(params, hashed.Prefix, hashed.Hash, hashed.Salt, row["description"], row["created_at"])
+		}
+
+		if _, err := s.cfAPI.ExecuteSQL(ctx, query.String(), params); err != nil {
+			return fmt.Errorf("error copying API keys: %w", err)
+		}
+	}
+
+	if _, err := s.cfAPI.ExecuteSQL(ctx, `
+		DROP TABLE api_keys;
+		ALTER TABLE api_keys_hashed RENAME TO api_keys;
+	`, nil); err != nil {
+		return fmt.Errorf("error swapping API keys table: %w", err)
+	}
+
+	log.Printf("✅ Hashed %d API keys", len(rows))
+	return nil
+}
+
+// tableColumns returns the column names of a table, or none if it doesn't
+// exist. The table name must not come from user input.
+func tableColumns(ctx context.Context, cfAPI *CloudflareAPI, table string) (map[string]bool, error) {
+	result, err := cfAPI.ExecuteSQL(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading columns of %s: %w", table, err)
+	}
+
+	columns := make(map[string]bool)
+	for _, row := range result.Rows() {
+		columns[row["name"].(string)] = true
+	}
+	return columns, nil
+}
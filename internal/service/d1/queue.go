@@ -1,100 +1,610 @@
 package d1
 
 import (
+	"cmp"
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const queueTableSQL = `
+	CREATE TABLE IF NOT EXISTS queued_users (
+		user_id INTEGER PRIMARY KEY,
+		queued_at INTEGER NOT NULL,
+		processed INTEGER NOT NULL DEFAULT 0,
+		processing INTEGER NOT NULL DEFAULT 0,
+		flagged INTEGER NOT NULL DEFAULT 0,
+		lease_expires_at INTEGER,
+		lease_token TEXT,
+		processed_at INTEGER,
+		confidence REAL,
+		reasons TEXT,
+		submitted_by INTEGER,
+		source TEXT,
+		priority INTEGER NOT NULL DEFAULT 1
+	);
+
+	-- Index to efficiently find unprocessed and non-processing users ordered by queue time
+	CREATE INDEX IF NOT EXISTS idx_queue_status
+	ON queued_users (processed, processing, queued_at)
+	WHERE processed = 0 AND processing = 0;
+
+	-- Index to efficiently find processed and flagged users
+	CREATE INDEX IF NOT EXISTS idx_processed_flagged
+	ON queued_users (processed, flagged)
+	WHERE processed = 1 AND flagged = 1;
+`
+
+// queueIndexesSQL creates the indexes on columns added to queued_users, once
+// the columns exist.
+const queueIndexesSQL = `
+	-- Index to efficiently find leases that have expired
+	CREATE INDEX IF NOT EXISTS idx_queue_leases
+	ON queued_users (lease_expires_at)
+	WHERE processed = 0 AND processing = 1;
+
+	-- Index to efficiently find unprocessed users by priority and queue time
+	CREATE INDEX IF NOT EXISTS idx_queue_priority
+	ON queued_users (priority DESC, queued_at)
+	WHERE processed = 0 AND processing = 0;
+`
+
+const (
+	// DefaultQueueCooldown is how long after being queued a user can't be
+	// queued again, unless the worker is configured otherwise.
+	DefaultQueueCooldown = 7 * 24 * time.Hour
+
+	// DefaultLeaseDuration is how long claimed users are leased for unless
+	// the consumer asks for another duration.
+	DefaultLeaseDuration = 10 * time.Minute
+
+	// MaxLeaseDuration is the longest lease a consumer can ask for.
+	MaxLeaseDuration = time.Hour
+
+	// MaxClaimSize is the most users that can be claimed at once.
+	MaxClaimSize = 100
+
+	// MaxQueueBatchSize is the most users that can be queued at once.
+	MaxQueueBatchSize = 200
+
+	// queueBatchSize is the number of users queued per statement, each
+	// binding one parameter besides the five shared by the batch.
+	queueBatchSize = maxBoundParams - 5
+
+	// MaxSourceLength is the longest source that can be recorded for a user.
+	MaxSourceLength = 200
+
+	// resultBatchSize is the number of results written per statement, each
+	// binding four parameters besides the time and lease token.
+	resultBatchSize = (maxBoundParams - 2) / 4
+
+	// releaseBatchSize is the number of users released per statement, each
+	// binding one parameter besides the lease token.
+	releaseBatchSize = maxBoundParams - 1
+)
+
+// Queue priorities. Users with a higher priority are claimed first.
+const (
+	PriorityLow    = 0
+	PriorityNormal = 1
+	PriorityHigh   = 2
+)
+
+var ErrUnknownPriority = errors.New("unknown priority")
+
+// priorityNames are the names of the queue priorities.
+var priorityNames = map[int]string{
+	PriorityLow:    "low",
+	PriorityNormal: "normal",
+	PriorityHigh:   "high",
+}
+
+// ParsePriority returns the priority with the given name. An empty name is
+// the normal priority.
+func ParsePriority(name string) (int, error) {
+	if name == "" {
+		return PriorityNormal, nil
+	}
+	for priority, priorityName := range priorityNames {
+		if priorityName == name {
+			return priority, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrUnknownPriority, name)
+}
+
+// PriorityName returns the name of a priority.
+func PriorityName(priority int) string {
+	if name, ok := priorityNames[priority]; ok {
+		return name
+	}
+	return strconv.Itoa(priority)
+}
+
+// QueueOptions describe who queued users, why and how urgently. SubmittedBy
+// is the ID of the API key that queued the users, or zero if unknown, and
+// Source is an optional free-form reason.
+type QueueOptions struct {
+	SubmittedBy int64
+	Source      string
+	Priority    int
+}
+
+// ClaimedUser is a queued user leased to a consumer for processing.
+type ClaimedUser struct {
+	ID       uint64
+	QueuedAt int64
+	Source   string
+	Priority int
+}
+
 var (
 	ErrUserAlreadyFlagged = errors.New("user is already flagged or confirmed")
-	ErrUserRecentlyQueued = errors.New("user was queued within the past 7 days")
+	ErrUserRecentlyQueued = errors.New("user was queued within the cooldown")
 )
 
+// QueueResult is the outcome of processing a queued user. A result that isn't
+// processed releases the user back to the queue. Reasons is the JSON encoded
+// reasons for flagging, or empty if there are none.
+type QueueResult struct {
+	UserID     uint64
+	Processed  bool
+	Flagged    bool
+	Confidence *float64
+	Reasons    string
+}
+
+// Outcomes of adding a user to the queue.
+const (
+	QueueOutcomeQueued         = "queued"
+	QueueOutcomeAlreadyFlagged = "already_flagged"
+	QueueOutcomeRecentlyQueued = "recently_queued"
+	QueueOutcomeQuotaExceeded  = "quota_exceeded"
+)
+
+// Queue statuses of a user.
+const (
+	QueueStatusNotQueued  = "not_queued"
+	QueueStatusPending    = "pending"
+	QueueStatusProcessing = "processing"
+	QueueStatusClean      = "clean"
+	QueueStatusFlagged    = "flagged"
+)
+
+// QueueStatus is where a user is in the queue, and who queued it. QueuedAt
+// and ProcessedAt are zero if the user isn't queued or hasn't been processed.
+type QueueStatus struct {
+	UserID      uint64
+	Status      string
+	QueuedAt    int64
+	ProcessedAt int64
+	QueueOptions
+}
+
 // QueueService handles user queue operations in D1.
 type QueueService struct {
 	db          *sql.DB
 	flagService *FlagService
+	cooldown    time.Duration
 }
 
-// NewQueueService creates a new queue service.
-func NewQueueService(db *sql.DB, flagService *FlagService) *QueueService {
+// NewQueueService creates a new queue service. Users can't be queued again
+// until the cooldown has passed since they were last queued.
+func NewQueueService(db *sql.DB, flagService *FlagService, cooldown time.Duration) *QueueService {
 	return &QueueService{
 		db:          db,
 		flagService: flagService,
+		cooldown:    cooldown,
 	}
 }
 
+// Cooldown returns how long after being queued a user can't be queued again.
+func (s *QueueService) Cooldown() time.Duration {
+	return s.cooldown
+}
+
 // QueueUser adds a user to the processing queue.
-func (s *QueueService) QueueUser(ctx context.Context, userID uint64) error {
-	// Step 1: Check if the user is already flagged or confirmed
-	flags, err := s.flagService.GetUserFlags(ctx, []uint64{userID})
+func (s *QueueService) QueueUser(ctx context.Context, userID uint64, opts QueueOptions) error {
+	outcomes, err := s.QueueUsers(ctx, []uint64{userID}, opts, 1)
 	if err != nil {
-		return fmt.Errorf("error checking user flags: %w", err)
+		return err
 	}
 
-	if _, exists := flags[userID]; exists {
+	switch outcomes[userID] {
+	case QueueOutcomeAlreadyFlagged:
 		return ErrUserAlreadyFlagged
+	case QueueOutcomeRecentlyQueued:
+		return ErrUserRecentlyQueued
+	}
+	return nil
+}
+
+// QueueUsers adds up to limit users to the processing queue and returns the
+// outcome for each user. Users that are flagged or were queued within the
+// cooldown aren't queued and don't count towards the limit. Users that would
+// be queued beyond the limit get QueueOutcomeQuotaExceeded.
+func (s *QueueService) QueueUsers(
+	ctx context.Context, ids []uint64, opts QueueOptions, limit int,
+) (map[uint64]string, error) {
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+
+	outcomes := make(map[uint64]string, len(ids))
+	for i := 0; i < len(ids); i += queueBatchSize {
+		end := i + queueBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		queued, err := s.queueBatch(ctx, ids[i:end], opts, limit, outcomes)
+		if err != nil {
+			return nil, err
+		}
+		limit -= queued
+	}
+
+	return outcomes, nil
+}
+
+// queueBatch queues up to limit of a batch of distinct users, adding their
+// outcomes to outcomes. It returns the number of users queued.
+func (s *QueueService) queueBatch(
+	ctx context.Context, ids []uint64, opts QueueOptions, limit int, outcomes map[uint64]string,
+) (int, error) {
+	now := time.Now()
+	cutoff := now.Add(-s.cooldown).Unix()
+
+	// Step 1: Skip users that are already flagged or confirmed
+	flags, err := s.flagService.GetUserFlags(ctx, ids)
+	if err != nil {
+		return 0, fmt.Errorf("error checking user flags: %w", err)
+	}
+
+	var candidates []uint64
+	for _, id := range ids {
+		if _, exists := flags[id]; exists {
+			outcomes[id] = QueueOutcomeAlreadyFlagged
+			continue
+		}
+		candidates = append(candidates, id)
+	}
+
+	// Step 2: If not every candidate fits in the limit, leave out the users
+	// within their cooldown before choosing which to queue
+	if len(candidates) > limit {
+		if candidates, err = s.candidatesWithinLimit(ctx, candidates, cutoff, limit, outcomes); err != nil {
+			return 0, err
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+
+	// Step 3: Add new users and re-queue users last queued before the
+	// cooldown, in one statement so concurrent requests agree on the outcome
+	var source any
+	if opts.Source != "" {
+		source = opts.Source
+	}
+
+	var query strings.Builder
+	query.WriteString(`
+		INSERT INTO queued_users (user_id, queued_at, submitted_by, source, priority)
+		SELECT column1, ?, ?, ?, ? FROM (VALUES `)
+	params := make([]any, 0, len(candidates)+5)
+	params = append(params, now.Unix(), nullIfZero(opts.SubmittedBy), source, opts.Priority)
+	for i, id := range candidates {
+		if i > 0 {
+			query.WriteString(",")
+		}
+		query.WriteString("(?)")
+		params = append(params, id)
 	}
+	// "WHERE true" keeps SQLite from reading ON CONFLICT as a join constraint
+	query.WriteString(`) WHERE true
+		ON CONFLICT (user_id) DO UPDATE SET
+			queued_at = excluded.queued_at, processed = 0, processing = 0, flagged = 0,
+			lease_expires_at = NULL, lease_token = NULL, processed_at = NULL, confidence = NULL, reasons = NULL,
+			submitted_by = excluded.submitted_by, source = excluded.source, priority = excluded.priority
+		WHERE queued_users.queued_at <= ?
+		RETURNING user_id
+	`)
+	params = append(params, cutoff)
 
-	// Step 2: Check if the user was queued in the past 7 days
-	var queuedAt sql.NullInt64
-	err = s.db.QueryRowContext(ctx,
-		"SELECT queued_at FROM queued_users WHERE user_id = ?",
-		userID,
-	).Scan(&queuedAt)
+	queued, err := s.queryUserIDs(ctx, query.String(), params)
+	if err != nil {
+		return 0, fmt.Errorf("error adding users to queue: %w", err)
+	}
+
+	for _, id := range candidates {
+		outcomes[id] = QueueOutcomeRecentlyQueued
+	}
+	for _, id := range queued {
+		outcomes[id] = QueueOutcomeQueued
+	}
+	return len(queued), nil
+}
+
+// candidatesWithinLimit returns the first limit candidates that aren't within
+// their cooldown, given as the cutoff queue time. The outcomes of the other
+// candidates are added to outcomes.
+func (s *QueueService) candidatesWithinLimit(
+	ctx context.Context, candidates []uint64, cutoff int64, limit int, outcomes map[uint64]string,
+) ([]uint64, error) {
+	var query strings.Builder
+	query.WriteString("SELECT user_id FROM queued_users WHERE queued_at > ? AND user_id IN (")
+	params := make([]any, 0, 1+len(candidates))
+	params = append(params, cutoff)
+	for i, id := range candidates {
+		if i > 0 {
+			query.WriteString(",")
+		}
+		query.WriteString("?")
+		params = append(params, id)
+	}
+	query.WriteString(")")
 
-	// If we found a record, check its timestamp
-	if err == nil && queuedAt.Valid {
-		cutoffTime := time.Now().AddDate(0, 0, -7).Unix()
-		if queuedAt.Int64 > cutoffTime {
-			return ErrUserRecentlyQueued
+	recent, err := s.queryUserIDs(ctx, query.String(), params)
+	if err != nil {
+		return nil, fmt.Errorf("error checking queue cooldowns: %w", err)
+	}
+
+	var chosen []uint64
+	for _, id := range candidates {
+		switch {
+		case slices.Contains(recent, id):
+			outcomes[id] = QueueOutcomeRecentlyQueued
+		case len(chosen) < limit:
+			chosen = append(chosen, id)
+		default:
+			outcomes[id] = QueueOutcomeQuotaExceeded
 		}
+	}
+	return chosen, nil
+}
 
-		// Update existing record
-		_, err = s.db.ExecContext(ctx,
-			"UPDATE queued_users SET queued_at = ?, processed = 0 WHERE user_id = ?",
-			time.Now().Unix(), userID,
+// ClaimUsers leases up to limit of the unprocessed users with the highest
+// priority that have been queued the longest until leaseExpiresAt. Users
+// whose lease ended without a result are claimed again. Users being processed
+// without a lease, by consumers that predate leases, are left alone. It
+// returns the claimed users and the token that results for them must give.
+func (s *QueueService) ClaimUsers(
+	ctx context.Context, limit int, leaseExpiresAt time.Time,
+) ([]ClaimedUser, string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, "", fmt.Errorf("error generating lease token: %w", err)
+	}
+	leaseToken := hex.EncodeToString(token)
+
+	// Selecting and leasing happen in one statement, so concurrent claims
+	// can't lease the same user
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE queued_users SET processing = 1, lease_expires_at = ?, lease_token = ?
+		WHERE user_id IN (
+			SELECT user_id FROM queued_users
+			WHERE processed = 0 AND (processing = 0 OR lease_expires_at <= ?)
+			ORDER BY priority DESC, queued_at, user_id
+			LIMIT ?
 		)
-		return err
-	} else if !errors.Is(err, sql.ErrNoRows) {
-		return fmt.Errorf("error checking queue status: %w", err)
+		RETURNING user_id, queued_at, source, priority
+	`, leaseExpiresAt.Unix(), leaseToken, time.Now().Unix(), limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("error claiming queued users: %w", err)
 	}
+	defer rows.Close()
 
-	// Step 3: Add user to queue
-	_, err = s.db.ExecContext(ctx,
-		"INSERT INTO queued_users (user_id, queued_at, processed) VALUES (?, ?, 0)",
-		userID, time.Now().Unix(),
-	)
+	var users []ClaimedUser
+	for rows.Next() {
+		var user ClaimedUser
+		var source sql.NullString
+		if err := rows.Scan(&user.ID, &user.QueuedAt, &source, &user.Priority); err != nil {
+			return nil, "", fmt.Errorf("error scanning row: %w", err)
+		}
+		user.Source = source.String
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	// RETURNING doesn't keep the order of the subquery
+	slices.SortFunc(users, func(a, b ClaimedUser) int {
+		return cmp.Or(
+			cmp.Compare(b.Priority, a.Priority), cmp.Compare(a.QueuedAt, b.QueuedAt), cmp.Compare(a.ID, b.ID),
+		)
+	})
+	return users, leaseToken, nil
+}
+
+// ReportResults records the outcomes of processing queued users and clears
+// their leases. Only users still leased with leaseToken are updated, so a
+// consumer whose lease expired and was claimed by another can't overwrite the
+// new result. It returns the IDs of the users that were updated.
+func (s *QueueService) ReportResults(ctx context.Context, leaseToken string, results []QueueResult) ([]uint64, error) {
+	var processed []QueueResult
+	var released []uint64
+	for _, result := range results {
+		if result.Processed {
+			processed = append(processed, result)
+		} else {
+			released = append(released, result.UserID)
+		}
+	}
+
+	var updated []uint64
+	for i := 0; i < len(processed); i += resultBatchSize {
+		end := i + resultBatchSize
+		if end > len(processed) {
+			end = len(processed)
+		}
+
+		var query strings.Builder
+		query.WriteString(`
+			UPDATE queued_users SET
+				processed = 1, processing = 0, lease_expires_at = NULL, lease_token = NULL, processed_at = ?,
+				flagged = results.column2, confidence = results.column3, reasons = results.column4
+			FROM (VALUES `)
+		params := make([]any, 0, 2+(end-i)*4)
+		params = append(params, time.Now().Unix())
+		for j, result := range processed[i:end] {
+			if j > 0 {
+				query.WriteString(",")
+			}
+			query.WriteString("(?, ?, ?, ?)")
+
+			var reasons any
+			if result.Reasons != "" {
+				reasons = result.Reasons
+			}
+			params = append(params, result.UserID, result.Flagged, result.Confidence, reasons)
+		}
+		query.WriteString(`) AS results
+			WHERE queued_users.user_id = results.column1 AND queued_users.processed = 0
+				AND queued_users.processing = 1 AND queued_users.lease_token = ?
+			RETURNING user_id
+		`)
+		params = append(params, leaseToken)
+
+		ids, err := s.queryUserIDs(ctx, query.String(), params)
+		if err != nil {
+			return nil, fmt.Errorf("error recording queue results: %w", err)
+		}
+		updated = append(updated, ids...)
+	}
+
+	for i := 0; i < len(released); i += releaseBatchSize {
+		end := i + releaseBatchSize
+		if end > len(released) {
+			end = len(released)
+		}
+
+		var query strings.Builder
+		query.WriteString("UPDATE queued_users SET processing = 0, lease_expires_at = NULL, lease_token = NULL ")
+		query.WriteString("WHERE processed = 0 AND processing = 1 AND lease_token = ? AND user_id IN (")
+		params := make([]any, 0, 1+end-i)
+		params = append(params, leaseToken)
+		for j, id := range released[i:end] {
+			if j > 0 {
+				query.WriteString(",")
+			}
+			query.WriteString("?")
+			params = append(params, id)
+		}
+		query.WriteString(") RETURNING user_id")
+
+		ids, err := s.queryUserIDs(ctx, query.String(), params)
+		if err != nil {
+			return nil, fmt.Errorf("error releasing queued users: %w", err)
+		}
+		updated = append(updated, ids...)
+	}
+
+	return updated, nil
+}
+
+// queryUserIDs runs a statement returning user IDs and returns the IDs.
+func (s *QueueService) queryUserIDs(ctx context.Context, query string, params []any) ([]uint64, error) {
+	rows, err := s.db.QueryContext(ctx, query, params...)
 	if err != nil {
-		return fmt.Errorf("error adding user to queue: %w", err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	return nil
+	var ids []uint64
+	for rows.Next() {
+		var id uint64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetQueueStatuses returns the queue status of each of the given users.
+func (s *QueueService) GetQueueStatuses(ctx context.Context, ids []uint64) (map[uint64]QueueStatus, error) {
+	statuses := make(map[uint64]QueueStatus, len(ids))
+	for _, id := range ids {
+		statuses[id] = QueueStatus{UserID: id, Status: QueueStatusNotQueued}
+	}
+	if len(ids) == 0 {
+		return statuses, nil
+	}
+
+	var query strings.Builder
+	query.WriteString(`
+		SELECT user_id, queued_at, processed, processing, flagged, lease_expires_at, processed_at,
+			submitted_by, source, priority
+		FROM queued_users WHERE user_id IN (`)
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		if i > 0 {
+			query.WriteString(",")
+		}
+		query.WriteString("?")
+		args[i] = id
+	}
+	query.WriteString(")")
+
+	rows, err := s.db.QueryContext(ctx, query.String(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying queue status: %w", err)
+	}
+	defer rows.Close()
+
+	now := time.Now().Unix()
+	for rows.Next() {
+		var status QueueStatus
+		var processed, processing, flagged bool
+		var leaseExpiresAt, processedAt, submittedBy sql.NullInt64
+		var source sql.NullString
+		if err := rows.Scan(
+			&status.UserID, &status.QueuedAt, &processed, &processing, &flagged, &leaseExpiresAt, &processedAt,
+			&submittedBy, &source, &status.Priority,
+		); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		status.ProcessedAt = processedAt.Int64
+		status.SubmittedBy = submittedBy.Int64
+		status.Source = source.String
+
+		switch {
+		case processed && flagged:
+			status.Status = QueueStatusFlagged
+		case processed:
+			status.Status = QueueStatusClean
+		case processing && (!leaseExpiresAt.Valid || leaseExpiresAt.Int64 > now):
+			status.Status = QueueStatusProcessing
+		default:
+			// Users whose lease expired are waiting to be claimed again
+			status.Status = QueueStatusPending
+		}
+		statuses[status.UserID] = status
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return statuses, nil
 }
 
-// InitQueueTable ensures the queue table exists.
+// InitQueueTable ensures the queue table exists and is up to date.
 func (s *QueueService) InitQueueTable(ctx context.Context) error {
-	_, err := s.db.ExecContext(ctx, `
-        CREATE TABLE IF NOT EXISTS queued_users (
-            user_id INTEGER PRIMARY KEY,
-            queued_at INTEGER NOT NULL,
-            processed INTEGER NOT NULL DEFAULT 0,
-            processing INTEGER NOT NULL DEFAULT 0,
-            flagged INTEGER NOT NULL DEFAULT 0
-        );
-        
-        -- Index to efficiently find unprocessed and non-processing users ordered by queue time
-        CREATE INDEX IF NOT EXISTS idx_queue_status 
-        ON queued_users (processed, processing, queued_at)
-        WHERE processed = 0 AND processing = 0;
-
-        -- Index to efficiently find processed and flagged users
-        CREATE INDEX IF NOT EXISTS idx_processed_flagged
-        ON queued_users (processed, flagged)
-        WHERE processed = 1 AND flagged = 1;
-    `)
+	if _, err := s.db.ExecContext(ctx, queueTableSQL); err != nil {
+		return err
+	}
+	if err := addColumns(ctx, s.db, queueColumns); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, queueIndexesSQL)
 	return err
 }
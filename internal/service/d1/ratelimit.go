@@ -0,0 +1,175 @@
+package d1
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const rateLimitCountersTableSQL = `
+	CREATE TABLE IF NOT EXISTS rate_limit_counters (
+		key_id INTEGER NOT NULL,
+		counter TEXT NOT NULL,
+		window_start INTEGER NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (key_id, counter, window_start)
+	);
+`
+
+// Rate limit counters.
+const (
+	CounterRequests = "requests"
+	CounterIDs      = "ids"
+	CounterQueue    = "queue"
+)
+
+// counterRetention is how long counters are kept after their window starts.
+// It must be at least as long as the longest window.
+const counterRetention = 48 * time.Hour
+
+// RateLimit is the state of a counter after an attempt to consume from it.
+type RateLimit struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64
+	Reset     time.Time
+
+	windowStart int64
+}
+
+// RetryAfter returns how long to wait until the window resets.
+func (l *RateLimit) RetryAfter(now time.Time) time.Duration {
+	return max(l.Reset.Sub(now), 0)
+}
+
+// RateLimitService counts API key usage in fixed windows in D1.
+type RateLimitService struct {
+	db *sql.DB
+}
+
+// NewRateLimitService creates a new rate limit service.
+func NewRateLimitService(db *sql.DB) *RateLimitService {
+	return &RateLimitService{
+		db: db,
+	}
+}
+
+// Consume adds amount to a key's counter for the current window if the total
+// stays within limit. Nothing is consumed when the limit would be exceeded.
+func (s *RateLimitService) Consume(
+	ctx context.Context, keyID int64, counter string, window time.Duration, limit, amount int64,
+) (*RateLimit, error) {
+	now := time.Now()
+	start := now.Truncate(window)
+	result := &RateLimit{
+		Limit:       limit,
+		Reset:       start.Add(window),
+		windowStart: start.Unix(),
+	}
+
+	// Counting and checking happen in one statement, so concurrent requests
+	// can't both take the last of the limit
+	var count int64
+	err := sql.ErrNoRows
+	if amount <= limit {
+		err = s.db.QueryRowContext(ctx, `
+			INSERT INTO rate_limit_counters (key_id, counter, window_start, count)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT (key_id, counter, window_start) DO UPDATE SET count = count + excluded.count
+			WHERE count + excluded.count <= ?
+			RETURNING count
+		`, keyID, counter, start.Unix(), amount, limit).Scan(&count)
+	}
+
+	switch {
+	case err == nil:
+		result.Allowed = true
+		if count == amount {
+			// First use in this window, so older windows can be dropped
+			if err := s.pruneCounters(ctx, keyID, now); err != nil {
+				return nil, err
+			}
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		if count, err = s.count(ctx, keyID, counter, start); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("error updating rate limit counter: %w", err)
+	}
+
+	result.Remaining = max(limit-count, 0)
+	return result, nil
+}
+
+// Peek returns the state of a key's counter for the current window without
+// consuming from it. Allowed reports whether any of the limit remains.
+func (s *RateLimitService) Peek(
+	ctx context.Context, keyID int64, counter string, window time.Duration, limit int64,
+) (*RateLimit, error) {
+	start := time.Now().Truncate(window)
+	count, err := s.count(ctx, keyID, counter, start)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RateLimit{
+		Allowed:     count < limit,
+		Limit:       limit,
+		Remaining:   max(limit-count, 0),
+		Reset:       start.Add(window),
+		windowStart: start.Unix(),
+	}, nil
+}
+
+// Refund gives back amount of what was consumed from a key's counter in the
+// window of limit, such as when a request used less than it reserved.
+func (s *RateLimitService) Refund(
+	ctx context.Context, keyID int64, counter string, limit *RateLimit, amount int64,
+) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
+		UPDATE rate_limit_counters SET count = MAX(count - ?, 0)
+		WHERE key_id = ? AND counter = ? AND window_start = ?
+	`, amount, keyID, counter, limit.windowStart); err != nil {
+		return fmt.Errorf("error refunding rate limit counter: %w", err)
+	}
+
+	limit.Remaining = min(limit.Remaining+amount, limit.Limit)
+	return nil
+}
+
+// InitRateLimitTable ensures the rate limit counters table exists.
+func (s *RateLimitService) InitRateLimitTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, rateLimitCountersTableSQL)
+	return err
+}
+
+// count returns a key's counter for the window starting at start.
+func (s *RateLimitService) count(ctx context.Context, keyID int64, counter string, start time.Time) (int64, error) {
+	var count int64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT count FROM rate_limit_counters WHERE key_id = ? AND counter = ? AND window_start = ?",
+		keyID, counter, start.Unix(),
+	).Scan(&count)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("error reading rate limit counter: %w", err)
+	}
+	return count, nil
+}
+
+// pruneCounters removes a key's counters for windows that have ended.
+func (s *RateLimitService) pruneCounters(ctx context.Context, keyID int64, now time.Time) error {
+	if _, err := s.db.ExecContext(ctx,
+		"DELETE FROM rate_limit_counters WHERE key_id = ? AND window_start < ?",
+		keyID, now.Add(-counterRetention).Unix(),
+	); err != nil {
+		return fmt.Errorf("error pruning rate limit counters: %w", err)
+	}
+	return nil
+}
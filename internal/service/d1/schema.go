@@ -0,0 +1,151 @@
+package d1
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// maxBoundParams is the most parameters D1 binds in a single statement.
+// Statements written in batches take their batch size from it.
+const maxBoundParams = 100
+
+const userFlagsTableSQL = `
+	CREATE TABLE IF NOT EXISTS user_flags (
+		user_id INTEGER PRIMARY KEY,
+		flag_type INTEGER NOT NULL,
+		confidence REAL NOT NULL,
+		reasons TEXT
+	);
+`
+
+const apiKeysTableSQL = `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		prefix TEXT NOT NULL UNIQUE,
+		key_hash TEXT NOT NULL,
+		salt TEXT NOT NULL,
+		description TEXT,
+		scopes TEXT NOT NULL DEFAULT ` + defaultScopesSQL + `,
+		expires_at INTEGER,
+		disabled INTEGER NOT NULL DEFAULT 0,
+		last_used_at INTEGER,
+		requests_per_minute INTEGER,
+		daily_id_quota INTEGER,
+		daily_queue_quota INTEGER,
+		replaced_by INTEGER,
+		rotated_at INTEGER,
+		created_at INTEGER NOT NULL
+	);
+`
+
+// addedColumn is a column added to a table after the table was first released.
+// CREATE statements already include it, but older tables need it added.
+type addedColumn struct {
+	table      string
+	name       string
+	definition string
+}
+
+// apiKeyColumns lists the columns added to api_keys.
+var apiKeyColumns = []addedColumn{
+	{"api_keys", "scopes", "TEXT NOT NULL DEFAULT " + defaultScopesSQL},
+	{"api_keys", "expires_at", "INTEGER"},
+	{"api_keys", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+	{"api_keys", "last_used_at", "INTEGER"},
+	{"api_keys", "requests_per_minute", "INTEGER"},
+	{"api_keys", "daily_id_quota", "INTEGER"},
+	{"api_keys", "replaced_by", "INTEGER"},
+	{"api_keys", "rotated_at", "INTEGER"},
+	{"api_keys", "daily_queue_quota", "INTEGER"},
+}
+
+// queueColumns lists the columns added to queued_users.
+var queueColumns = []addedColumn{
+	{"queued_users", "lease_expires_at", "INTEGER"},
+	{"queued_users", "processed_at", "INTEGER"},
+	{"queued_users", "confidence", "REAL"},
+	{"queued_users", "reasons", "TEXT"},
+	{"queued_users", "submitted_by", "INTEGER"},
+	{"queued_users", "source", "TEXT"},
+	{"queued_users", "priority", "INTEGER NOT NULL DEFAULT 1"},
+	{"queued_users", "lease_token", "TEXT"},
+}
+
+// cliSchemaSQL creates every table the CLI manages on D1.
+const cliSchemaSQL = userFlagsTableSQL + apiKeysTableSQL + syncCheckpointsTableSQL +
+	flagSnapshotsTableSQL + syncRunsTableSQL + datasetMetaTableSQL
+
+// InitSchema creates every table the worker reads from. On D1 these tables are
+// created by the sync, so this is only needed for local databases.
+func InitSchema(ctx context.Context, db *sql.DB) error {
+	schemaSQL := userFlagsTableSQL + apiKeysTableSQL + queueTableSQL + datasetMetaTableSQL +
+		rateLimitCountersTableSQL + apiKeyUsageTableSQL
+	if _, err := db.ExecContext(ctx, schemaSQL); err != nil {
+		return fmt.Errorf("error creating tables: %w", err)
+	}
+	if err := addColumns(ctx, db, apiKeyColumns); err != nil {
+		return err
+	}
+	if err := addColumns(ctx, db, queueColumns); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, queueIndexesSQL); err != nil {
+		return fmt.Errorf("error creating queue indexes: %w", err)
+	}
+
+	// The triggers need every api_keys column, so they come last
+	if _, err := db.ExecContext(ctx, apiKeyStateSQL); err != nil {
+		return fmt.Errorf("error creating API key version triggers: %w", err)
+	}
+	return nil
+}
+
+// addColumns adds the given columns to tables that don't have them yet.
+func addColumns(ctx context.Context, db *sql.DB, columns []addedColumn) error {
+	existing := make(map[string]map[string]bool)
+	for _, column := range columns {
+		if existing[column.table] == nil {
+			names, err := columnNames(ctx, db, column.table)
+			if err != nil {
+				return err
+			}
+			existing[column.table] = names
+		}
+		if existing[column.table][column.name] {
+			continue
+		}
+
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(
+			"ALTER TABLE %s ADD COLUMN %s %s", column.table, column.name, column.definition,
+		)); err != nil {
+			return fmt.Errorf("error adding column %s.%s: %w", column.table, column.name, err)
+		}
+	}
+	return nil
+}
+
+// columnNames returns the column names of a table. The table name must not
+// come from user input.
+func columnNames(ctx context.Context, db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, fmt.Errorf("error reading columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	names := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		names[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return names, nil
+}
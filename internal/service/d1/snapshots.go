@@ -0,0 +1,249 @@
+package d1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// DefaultKeepSnapshots is the number of previous datasets kept for rollbacks.
+const DefaultKeepSnapshots = 3
+
+const flagSnapshotsTableSQL = `
+	CREATE TABLE IF NOT EXISTS flag_snapshots (
+		name TEXT PRIMARY KEY,
+		created_at INTEGER NOT NULL,
+		row_count INTEGER NOT NULL,
+		flagged_count INTEGER NOT NULL,
+		confirmed_count INTEGER NOT NULL
+	);
+`
+
+var (
+	ErrSnapshotNotFound    = errors.New("snapshot not found")
+	ErrInvalidSnapshotName = errors.New("invalid snapshot name")
+)
+
+// snapshotNamePattern matches the table names used for snapshots. Names are
+// validated against it before being used as identifiers in SQL.
+var snapshotNamePattern = regexp.MustCompile(`^flags_snapshot_[0-9]+$`)
+
+// Snapshot represents a previous user_flags table kept for rollbacks.
+type Snapshot struct {
+	Name           string
+	CreatedAt      int64
+	RowCount       int64
+	FlaggedCount   int64
+	ConfirmedCount int64
+}
+
+// SnapshotService manages flag snapshots in D1.
+type SnapshotService struct {
+	cfAPI *CloudflareAPI
+}
+
+// NewSnapshotService creates a new snapshot service.
+func NewSnapshotService(cfAPI *CloudflareAPI) *SnapshotService {
+	return &SnapshotService{
+		cfAPI: cfAPI,
+	}
+}
+
+// ListSnapshots returns all snapshots, newest first.
+func (s *SnapshotService) ListSnapshots(ctx context.Context) ([]Snapshot, error) {
+	if _, err := s.cfAPI.ExecuteSQL(ctx, flagSnapshotsTableSQL, nil); err != nil {
+		return nil, fmt.Errorf("error creating snapshots table: %w", err)
+	}
+
+	result, err := s.cfAPI.ExecuteSQL(ctx, `
+		SELECT name, created_at, row_count, flagged_count, confirmed_count
+		FROM flag_snapshots ORDER BY created_at DESC, name DESC
+	`, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error querying snapshots: %w", err)
+	}
+
+	rows := result.Rows()
+	snapshots := make([]Snapshot, 0, len(rows))
+	for _, row := range rows {
+		snapshots = append(snapshots, Snapshot{
+			Name:           row["name"].(string),
+			CreatedAt:      int64(row["created_at"].(float64)),
+			RowCount:       int64(row["row_count"].(float64)),
+			FlaggedCount:   int64(row["flagged_count"].(float64)),
+			ConfirmedCount: int64(row["confirmed_count"].(float64)),
+		})
+	}
+
+	return snapshots, nil
+}
+
+// Rollback atomically swaps the named snapshot back in as user_flags. If name
+// is empty, the most recent snapshot is used. The replaced dataset is kept as
+// a new snapshot so the rollback itself can be undone.
+func (s *SnapshotService) Rollback(ctx context.Context, name string) (*Snapshot, error) {
+	snapshots, err := s.ListSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var target *Snapshot
+	for i := range snapshots {
+		if name == "" || snapshots[i].Name == name {
+			target = &snapshots[i]
+			break
+		}
+	}
+	if target == nil {
+		return nil, ErrSnapshotNotFound
+	}
+
+	current, err := s.countFlags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.swapIn(ctx, target.Name, current); err != nil {
+		return nil, err
+	}
+
+	restored := flagCounts{1: target.FlaggedCount, 2: target.ConfirmedCount}
+	if err := publishDatasetMeta(ctx, s.cfAPI, restored, true, false); err != nil {
+		return nil, err
+	}
+
+	return target, nil
+}
+
+// swapIn atomically replaces user_flags with the given source table. The
+// replaced table is kept as a new snapshot described by current, and the
+// source's snapshot record is removed if it was a snapshot.
+func (s *SnapshotService) swapIn(ctx context.Context, source string, current flagCounts) (string, error) {
+	if source != "new_flags" && !snapshotNamePattern.MatchString(source) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidSnapshotName, source)
+	}
+
+	retired, now, err := s.newSnapshotName(ctx, source)
+	if err != nil {
+		return "", err
+	}
+
+	// Identifiers can't be bound as parameters, so the statement is built from
+	// validated table names and integer literals only
+	swapSQL := fmt.Sprintf(`
+		-- Keep the current table as a snapshot
+		ALTER TABLE user_flags RENAME TO %[1]s;
+		INSERT INTO flag_snapshots (name, created_at, row_count, flagged_count, confirmed_count)
+		VALUES ('%[1]s', %[2]d, %[3]d, %[4]d, %[5]d);
+
+		-- Rename the source to be the main table
+		ALTER TABLE %[6]s RENAME TO user_flags;
+		DELETE FROM flag_snapshots WHERE name = '%[6]s';
+	`, retired, now, current.total(), current[1], current[2], source)
+
+	if _, err := s.cfAPI.ExecuteSQL(ctx, swapSQL, nil); err != nil {
+		return "", fmt.Errorf("error swapping tables: %w", err)
+	}
+
+	return retired, nil
+}
+
+// copyLive copies user_flags, described by current, into a new snapshot while
+// keeping it in place. It returns the name of the snapshot and the number of
+// rows written.
+func (s *SnapshotService) copyLive(ctx context.Context, current flagCounts) (string, int64, error) {
+	name, now, err := s.newSnapshotName(ctx, "")
+	if err != nil {
+		return "", 0, err
+	}
+
+	copySQL := fmt.Sprintf(`
+		CREATE TABLE %[1]s (
+			user_id INTEGER PRIMARY KEY,
+			flag_type INTEGER NOT NULL,
+			confidence REAL NOT NULL,
+			reasons TEXT
+		);
+		INSERT INTO %[1]s (user_id, flag_type, confidence, reasons)
+		SELECT user_id, flag_type, confidence, reasons FROM user_flags;
+		INSERT INTO flag_snapshots (name, created_at, row_count, flagged_count, confirmed_count)
+		VALUES ('%[1]s', %[2]d, %[3]d, %[4]d, %[5]d);
+	`, name, now, current.total(), current[1], current[2])
+
+	result, err := s.cfAPI.ExecuteSQL(ctx, copySQL, nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("error copying flags: %w", err)
+	}
+
+	return name, result.TotalMeta().RowsWritten, nil
+}
+
+// newSnapshotName returns a snapshot name that no snapshot or the given
+// source table uses yet, even if one was taken this second, along with the
+// creation time it is based on.
+func (s *SnapshotService) newSnapshotName(ctx context.Context, source string) (string, int64, error) {
+	snapshots, err := s.ListSnapshots(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	taken := map[string]bool{source: true}
+	for _, snapshot := range snapshots {
+		taken[snapshot.Name] = true
+	}
+
+	now := time.Now().Unix()
+	suffix := now
+	name := "flags_snapshot_" + strconv.FormatInt(suffix, 10)
+	for taken[name] {
+		suffix++
+		name = "flags_snapshot_" + strconv.FormatInt(suffix, 10)
+	}
+
+	return name, now, nil
+}
+
+// Prune drops all but the newest keep snapshots.
+func (s *SnapshotService) Prune(ctx context.Context, keep int) error {
+	snapshots, err := s.ListSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := max(keep, 0); i < len(snapshots); i++ {
+		name := snapshots[i].Name
+		if !snapshotNamePattern.MatchString(name) {
+			log.Printf("⚠️ Skipping snapshot with unexpected name: %s", name)
+			continue
+		}
+
+		if _, err := s.cfAPI.ExecuteSQL(ctx, fmt.Sprintf(`
+			DROP TABLE IF EXISTS %[1]s;
+			DELETE FROM flag_snapshots WHERE name = '%[1]s';
+		`, name), nil); err != nil {
+			return fmt.Errorf("error dropping snapshot %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// countFlags returns the number of flags per flag type in user_flags.
+func (s *SnapshotService) countFlags(ctx context.Context) (flagCounts, error) {
+	result, err := s.cfAPI.ExecuteSQL(ctx,
+		"SELECT flag_type, COUNT(*) AS count FROM user_flags GROUP BY flag_type",
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error counting live flags: %w", err)
+	}
+
+	counts := make(flagCounts)
+	for _, row := range result.Rows() {
+		counts[uint8(row["flag_type"].(float64))] = int64(row["count"].(float64))
+	}
+	return counts, nil
+}
@@ -0,0 +1,40 @@
+package d1
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSnapshotNameValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"flags_snapshot_1", true},
+		{"flags_snapshot_1760659200", true},
+		{"flags_snapshot_", false},
+		{"flags_snapshot_1a", false},
+		{"user_flags", false},
+		{"new_flags", false},
+		{"flags_snapshot_1; DROP TABLE user_flags", false},
+		{"flags_snapshot_1\n", false},
+		{"FLAGS_SNAPSHOT_1", false},
+	}
+
+	for _, tt := range tests {
+		if got := snapshotNamePattern.MatchString(tt.name); got != tt.valid {
+			t.Errorf("snapshotNamePattern.MatchString(%q) = %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+}
+
+func TestSwapInRejectsInvalidNames(t *testing.T) {
+	// Invalid names are rejected before any request is made
+	s := NewSnapshotService(nil)
+	for _, name := range []string{"user_flags", "flags_snapshot_1; DROP TABLE api_keys", ""} {
+		if _, err := s.swapIn(context.Background(), name, nil); !errors.Is(err, ErrInvalidSnapshotName) {
+			t.Errorf("swapIn(%q) = %v, want %v", name, err, ErrInvalidSnapshotName)
+		}
+	}
+}
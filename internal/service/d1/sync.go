@@ -1,10 +1,14 @@
 package d1
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -12,8 +16,11 @@ import (
 )
 
 const (
-	batchSize     = 25
-	maxConcurrent = 5
+	batchSize      = 25
+	checkpointSize = 500
+	maxConcurrent  = 5
+	livePageSize   = 5000
+	deleteSize     = maxBoundParams
 )
 
 // Record represents a user flag record.
@@ -28,60 +35,270 @@ type Record struct {
 type SyncService struct {
 	sourceDB    *sql.DB
 	cfAPI       *CloudflareAPI
+	snapshots   *SnapshotService
+	history     *SyncHistoryService
 	totalFlags  atomic.Int64
 	syncedFlags atomic.Int64
+	rowsWritten atomic.Int64
+}
+
+// SyncOptions configures a single sync run.
+type SyncOptions struct {
+	// Full rebuilds the whole dataset into new_flags and swaps it into place
+	// instead of applying only the rows that changed since the last sync.
+	Full bool
+
+	// Resume continues a full rebuild from the batches that a previous,
+	// interrupted run already committed to new_flags.
+	Resume bool
+
+	// MaxDropPercent is the largest drop in the total or per-type flag count,
+	// compared to the live dataset, that is published without Force.
+	MaxDropPercent float64
+
+	// Force publishes the dataset even if it fails the drop check.
+	Force bool
+
+	// KeepSnapshots is the number of previous datasets kept for rollbacks.
+	KeepSnapshots int
+
+	// SnapshotDelta makes delta syncs that change any rows copy the live
+	// dataset into a snapshot first. The copy costs one write per flag, so
+	// by default only full rebuilds keep snapshots.
+	SnapshotDelta bool
+
+	// SourceHost and Version are recorded in the sync run history.
+	SourceHost string
+	Version    string
+}
+
+// mode returns the name of the sync mode recorded in the run history.
+func (o SyncOptions) mode() string {
+	switch {
+	case o.Resume:
+		return "resume"
+	case o.Full:
+		return "full"
+	default:
+		return "delta"
+	}
 }
 
 // NewSyncService creates a new sync service.
-func NewSyncService(sourceDB *sql.DB, accountID, d1ID, token string) *SyncService {
+func NewSyncService(sourceDB *sql.DB, cfAPI *CloudflareAPI) *SyncService {
 	return &SyncService{
-		sourceDB: sourceDB,
-		cfAPI:    NewCloudflareAPI(accountID, d1ID, token),
+		sourceDB:  sourceDB,
+		cfAPI:     cfAPI,
+		snapshots: NewSnapshotService(cfAPI),
+		history:   NewSyncHistoryService(cfAPI),
 	}
 }
 
-// UpdateFlags syncs the latest flag data from Postgres to D1.
-func (s *SyncService) UpdateFlags(ctx context.Context) error {
+// UpdateFlags syncs the latest flag data from Postgres to D1 and records the
+// run in the sync history.
+func (s *SyncService) UpdateFlags(ctx context.Context, opts SyncOptions) error {
+	s.rowsWritten.Store(0)
+
 	if err := s.initializeTables(ctx); err != nil {
 		return fmt.Errorf("failed to initialize tables: %w", err)
 	}
 
-	records, err := s.fetchRecords(ctx)
+	run := &SyncRun{
+		Mode:       opts.mode(),
+		SourceHost: opts.SourceHost,
+		CLIVersion: opts.Version,
+	}
+	if err := s.history.StartRun(ctx, run); err != nil {
+		return fmt.Errorf("failed to record sync run: %w", err)
+	}
+
+	counts, err := s.syncFlags(ctx, run.ID, opts)
+
+	// Record the outcome even if the sync was interrupted
+	run.TotalCount = counts.total()
+	run.FlaggedCount = counts[1]
+	run.ConfirmedCount = counts[2]
+	run.RowsWritten = s.rowsWritten.Load()
+	switch {
+	case err != nil:
+		run.Outcome = SyncOutcomeFailed
+		run.Error = err.Error()
+	case run.TotalCount == 0:
+		run.Outcome = SyncOutcomeSkipped
+	default:
+		run.Outcome = SyncOutcomeSuccess
+	}
+
+	if finishErr := s.history.FinishRun(context.WithoutCancel(ctx), run); finishErr != nil {
+		log.Printf("⚠️ Failed to record sync outcome: %v", finishErr)
+	}
+
+	return err
+}
+
+// syncFlags fetches the records from Postgres and publishes them to D1,
+// returning the number of flags per flag type in the new dataset. A resumed
+// rebuild only fetches the users after its checkpoint.
+func (s *SyncService) syncFlags(ctx context.Context, runID int64, opts SyncOptions) (flagCounts, error) {
+	var cp *checkpoint
+	if opts.Resume {
+		var err error
+		cp, err = s.loadCheckpoint(ctx, runID)
+		if errors.Is(err, ErrNoCheckpoint) {
+			log.Printf("⚠️ No checkpoint to resume from, starting a fresh rebuild")
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	var after uint64
+	if cp != nil {
+		after = cp.lastUserID
+	}
+	records, err := s.fetchRecords(ctx, after)
 	if err != nil {
-		return fmt.Errorf("failed to fetch records: %w", err)
+		return nil, fmt.Errorf("failed to fetch records: %w", err)
+	}
+
+	// A resumed rebuild's dataset includes the users committed before the
+	// checkpoint, which are counted from new_flags
+	counts := countRecords(records)
+	if cp != nil {
+		staged, err := s.countStaged(ctx)
+		if err != nil {
+			return nil, err
+		}
+		counts.add(staged)
 	}
 
-	if len(records) == 0 {
+	if counts.total() == 0 {
 		log.Printf("No flags to sync")
-		return nil
+		return counts, nil
+	}
+
+	live, err := s.snapshots.countFlags(ctx)
+	if err != nil {
+		return counts, fmt.Errorf("failed to count live flags: %w", err)
+	}
+
+	if err := checkDrop(live, counts, opts.MaxDropPercent, opts.Force); err != nil {
+		return counts, fmt.Errorf("failed sanity check: %w", err)
+	}
+
+	changed := true
+	if opts.Full || opts.Resume {
+		if cp == nil {
+			if cp, err = s.startRebuild(ctx, runID); err != nil {
+				return counts, err
+			}
+		}
+		err = s.rebuildFlags(ctx, records, counts, live, cp, opts)
+	} else {
+		changed, err = s.applyDelta(ctx, records, live, opts)
+	}
+	if err != nil {
+		return counts, err
+	}
+
+	if err := publishDatasetMeta(ctx, s.cfAPI, counts, changed, true); err != nil {
+		return counts, fmt.Errorf("failed to publish dataset metadata: %w", err)
 	}
 
-	if err := s.processBatches(ctx, records); err != nil {
+	return counts, nil
+}
+
+// rebuildFlags writes the records into new_flags and swaps it with user_flags
+// once it holds the expected counts. Committed batches are checkpointed so an
+// interrupted rebuild can be resumed, and the replaced table is kept as a
+// snapshot.
+func (s *SyncService) rebuildFlags(
+	ctx context.Context, records []Record, expected, live flagCounts, cp *checkpoint, opts SyncOptions,
+) error {
+	if err := s.processBatches(ctx, "new_flags", records, cp); err != nil {
+		log.Printf("💡 Run sync with --resume to continue from the last committed batch")
 		return fmt.Errorf("failed to process batches: %w", err)
 	}
 
-	if err := s.swapTables(ctx); err != nil {
+	if err := s.verifyStagingTable(ctx, expected.total()); err != nil {
+		return fmt.Errorf("failed to verify staging table: %w", err)
+	}
+
+	snapshot, err := s.snapshots.swapIn(ctx, "new_flags", live)
+	if err != nil {
 		return fmt.Errorf("failed to swap tables: %w", err)
 	}
 
-	log.Printf("✅ Successfully synced %d flags", len(records))
+	if err := s.clearCheckpoints(ctx); err != nil {
+		return err
+	}
+
+	if err := s.snapshots.Prune(ctx, opts.KeepSnapshots); err != nil {
+		return fmt.Errorf("failed to prune snapshots: %w", err)
+	}
+	if opts.KeepSnapshots > 0 {
+		log.Printf("📸 Previous flags kept as snapshot %s", snapshot)
+	}
+
+	log.Printf("✅ Successfully synced %d flags (%d D1 rows written)", expected.total(), s.rowsWritten.Load())
 	return nil
 }
 
+// applyDelta compares records against the live user_flags table and only
+// writes the rows that were added, changed or removed. Before changing a
+// non-empty live dataset, described by liveCounts, it is copied into a
+// snapshot if opts.SnapshotDelta is set. It reports whether any rows changed.
+func (s *SyncService) applyDelta(
+	ctx context.Context, records []Record, liveCounts flagCounts, opts SyncOptions,
+) (bool, error) {
+	live, err := s.fetchLiveRecords(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch live records: %w", err)
+	}
+
+	upserts, deletes := diffRecords(live, records)
+	log.Printf("🔍 Found %d changed and %d removed flags (%d live, %d total)",
+		len(upserts), len(deletes), len(live), len(records))
+
+	keepSnapshot := opts.SnapshotDelta && opts.KeepSnapshots > 0
+	if (len(upserts) > 0 || len(deletes) > 0) && len(live) > 0 && keepSnapshot {
+		snapshot, rowsWritten, err := s.snapshots.copyLive(ctx, liveCounts)
+		if err != nil {
+			return false, fmt.Errorf("failed to snapshot flags: %w", err)
+		}
+		s.rowsWritten.Add(rowsWritten)
+
+		if err := s.snapshots.Prune(ctx, opts.KeepSnapshots); err != nil {
+			return false, fmt.Errorf("failed to prune snapshots: %w", err)
+		}
+		log.Printf("📸 Previous flags kept as snapshot %s", snapshot)
+	}
+
+	if len(upserts) > 0 {
+		if err := s.processBatches(ctx, "user_flags", upserts, nil); err != nil {
+			return false, fmt.Errorf("failed to process batches: %w", err)
+		}
+	}
+
+	if err := s.deleteRecords(ctx, deletes); err != nil {
+		return false, fmt.Errorf("failed to delete removed flags: %w", err)
+	}
+
+	log.Printf("✅ Successfully synced %d flags (%d upserted, %d deleted, %d D1 rows written)",
+		len(records), len(upserts), len(deletes), s.rowsWritten.Load())
+	return len(upserts) > 0 || len(deletes) > 0, nil
+}
+
 // initializeTables creates the necessary tables in D1.
 func (s *SyncService) initializeTables(ctx context.Context) error {
+	if _, err := s.cfAPI.ExecuteSQL(ctx, cliSchemaSQL, nil); err != nil {
+		return fmt.Errorf("error creating tables: %w", err)
+	}
+	return nil
+}
+
+// createStagingTable recreates the empty new_flags table used by full rebuilds.
+func (s *SyncService) createStagingTable(ctx context.Context) error {
 	createTableSQL := `
-		CREATE TABLE IF NOT EXISTS user_flags (
-			user_id INTEGER PRIMARY KEY,
-			flag_type INTEGER NOT NULL,
-			confidence REAL NOT NULL,
-			reasons TEXT
-		);
-		CREATE TABLE IF NOT EXISTS api_keys (
-			key TEXT PRIMARY KEY,
-			description TEXT,
-			created_at INTEGER NOT NULL
-		);
 		DROP TABLE IF EXISTS new_flags;
 		CREATE TABLE new_flags (
 			user_id INTEGER PRIMARY KEY,
@@ -91,19 +308,20 @@ func (s *SyncService) initializeTables(ctx context.Context) error {
 		);
 	`
 	if _, err := s.cfAPI.ExecuteSQL(ctx, createTableSQL, nil); err != nil {
-		return fmt.Errorf("error creating tables: %w", err)
+		return fmt.Errorf("error creating new_flags table: %w", err)
 	}
 	return nil
 }
 
-// fetchRecords retrieves all records from the source database.
-func (s *SyncService) fetchRecords(ctx context.Context) ([]Record, error) {
+// fetchRecords retrieves the records of users with an ID above after from the
+// source database.
+func (s *SyncService) fetchRecords(ctx context.Context, after uint64) ([]Record, error) {
 	log.Printf("📊 Fetching users from database...")
 	rows, err := s.sourceDB.QueryContext(ctx, `
-		SELECT id, 1 as flag_type, confidence, reasons FROM flagged_users
+		SELECT id, 1 as flag_type, confidence, reasons FROM flagged_users WHERE id > $1
 		UNION ALL
-		SELECT id, 2 as flag_type, confidence, reasons FROM confirmed_users
-	`)
+		SELECT id, 2 as flag_type, confidence, reasons FROM confirmed_users WHERE id > $1
+	`, int64(after))
 	if err != nil {
 		return nil, fmt.Errorf("error querying users: %w", err)
 	}
@@ -124,26 +342,123 @@ func (s *SyncService) fetchRecords(ctx context.Context) ([]Record, error) {
 		return nil, fmt.Errorf("error iterating rows: %w", err)
 	}
 
+	// Sort records so batches are deterministic across runs
+	slices.SortStableFunc(records, func(a, b Record) int {
+		return cmp.Compare(a.userID, b.userID)
+	})
+
 	return records, nil
 }
 
-// processBatches processes records in concurrent batches.
-func (s *SyncService) processBatches(ctx context.Context, records []Record) error {
+// fetchLiveRecords retrieves all records currently published in D1, keyed by user ID.
+func (s *SyncService) fetchLiveRecords(ctx context.Context) (map[uint64]Record, error) {
+	log.Printf("📥 Fetching live flags from D1...")
+
+	live := make(map[uint64]Record)
+	var lastID uint64
+	for {
+		result, err := s.cfAPI.ExecuteSQL(ctx, `
+			SELECT user_id, flag_type, confidence, reasons FROM user_flags
+			WHERE user_id > ? ORDER BY user_id LIMIT ?
+		`, []any{lastID, livePageSize})
+		if err != nil {
+			return nil, fmt.Errorf("error querying live flags: %w", err)
+		}
+
+		rows := result.Rows()
+		for _, row := range rows {
+			rec := Record{
+				userID:     uint64(row["user_id"].(float64)),
+				flagType:   uint8(row["flag_type"].(float64)),
+				confidence: float32(row["confidence"].(float64)),
+			}
+			if reasons, ok := row["reasons"].(string); ok {
+				rec.reasons = reasons
+			}
+			live[rec.userID] = rec
+			lastID = rec.userID
+		}
+
+		if len(rows) < livePageSize {
+			return live, nil
+		}
+	}
+}
+
+// diffRecords returns the records that are new or changed compared to live,
+// and the IDs of live records that no longer exist.
+func diffRecords(live map[uint64]Record, records []Record) ([]Record, []uint64) {
+	var upserts []Record
+	seen := make(map[uint64]struct{}, len(records))
+	for _, rec := range records {
+		seen[rec.userID] = struct{}{}
+		if current, exists := live[rec.userID]; !exists || current != rec {
+			upserts = append(upserts, rec)
+		}
+	}
+
+	var deletes []uint64
+	for id := range live {
+		if _, exists := seen[id]; !exists {
+			deletes = append(deletes, id)
+		}
+	}
+
+	return upserts, deletes
+}
+
+// deleteRecords removes the given user IDs from user_flags in chunks.
+func (s *SyncService) deleteRecords(ctx context.Context, ids []uint64) error {
+	for i := 0; i < len(ids); i += deleteSize {
+		end := i + deleteSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := ids[i:end]
+
+		// Build delete statement
+		var queryBuilder strings.Builder
+		queryBuilder.WriteString("DELETE FROM user_flags WHERE user_id IN (")
+
+		params := make([]any, len(chunk))
+		for j, id := range chunk {
+			if j > 0 {
+				queryBuilder.WriteString(",")
+			}
+			queryBuilder.WriteString("?")
+			params[j] = id
+		}
+		queryBuilder.WriteString(")")
+
+		result, err := s.cfAPI.ExecuteSQL(ctx, queryBuilder.String(), params)
+		if err != nil {
+			return fmt.Errorf("error executing D1 statement: %w", err)
+		}
+		s.rowsWritten.Add(result.TotalMeta().RowsWritten)
+	}
+	return nil
+}
+
+// processBatches processes records in concurrent batches. If a checkpoint is
+// given, it is advanced as batches are committed.
+func (s *SyncService) processBatches(ctx context.Context, table string, records []Record, cp *checkpoint) error {
 	s.totalFlags.Store(int64(len(records)))
 	s.syncedFlags.Store(0)
 
 	// Process records in concurrent batches
 	var wg sync.WaitGroup
 	sem := semaphore.NewWeighted(maxConcurrent)
-	errCh := make(chan error, len(records)/batchSize+1)
+	errCh := make(chan error, len(records)/checkpointSize+1)
 
-	for i := 0; i < len(records); i += batchSize {
-		end := i + batchSize
+	for i := 0; i < len(records); i += checkpointSize {
+		end := i + checkpointSize
 		if end > len(records) {
 			end = len(records)
 		}
 
 		batch := records[i:end]
+		batchIndex := i / checkpointSize
+
 		wg.Add(1)
 
 		// Acquire semaphore
@@ -151,14 +466,24 @@ func (s *SyncService) processBatches(ctx context.Context, records []Record) erro
 			return fmt.Errorf("failed to acquire semaphore: %w", err)
 		}
 
-		go func(batch []Record) {
+		go func(batchIndex int, batch []Record) {
 			defer wg.Done()
 			defer sem.Release(1)
 
-			if err := s.processBatch(ctx, batch); err != nil {
-				errCh <- fmt.Errorf("error processing batch: %w", err)
+			if err := s.processBatch(ctx, table, batch); err != nil {
+				errCh <- fmt.Errorf("error processing batch %d: %w", batchIndex, err)
+				return
+			}
+
+			if cp == nil {
+				return
 			}
-		}(batch)
+			if lastUserID, advanced := cp.complete(batchIndex, batch[len(batch)-1].userID); advanced {
+				if err := s.saveCheckpoint(ctx, cp.runID, lastUserID); err != nil {
+					errCh <- fmt.Errorf("error processing batch %d: %w", batchIndex, err)
+				}
+			}
+		}(batchIndex, batch)
 	}
 
 	// Wait for all batches to complete
@@ -175,24 +500,8 @@ func (s *SyncService) processBatches(ctx context.Context, records []Record) erro
 	return nil
 }
 
-// swapTables swaps the new_flags table with the user_flags table.
-func (s *SyncService) swapTables(ctx context.Context) error {
-	if _, err := s.cfAPI.ExecuteSQL(ctx, `
-		-- Rename the current table to old_flags
-		ALTER TABLE user_flags RENAME TO old_flags;
-		
-		-- Rename new_flags to be the main table
-		ALTER TABLE new_flags RENAME TO user_flags;
-		
-		-- Clean up the old table
-		DROP TABLE old_flags;
-	`, nil); err != nil {
-		return fmt.Errorf("error swapping tables: %w", err)
-	}
-	return nil
-}
-
-func (s *SyncService) processBatch(ctx context.Context, batch []Record) error {
+// processBatch upserts a batch of records into the given table.
+func (s *SyncService) processBatch(ctx context.Context, table string, batch []Record) error {
 	if len(batch) == 0 {
 		return nil
 	}
@@ -207,7 +516,7 @@ func (s *SyncService) processBatch(ctx context.Context, batch []Record) error {
 
 		// Build batch insert statement
 		sqlStmt := `
-			INSERT INTO new_flags (user_id, flag_type, confidence, reasons)
+			INSERT INTO ` + table + ` (user_id, flag_type, confidence, reasons)
 			VALUES
 		`
 
@@ -225,10 +534,18 @@ func (s *SyncService) processBatch(ctx context.Context, batch []Record) error {
 				rec.reasons,
 			)
 		}
+		sqlStmt += `
+			ON CONFLICT (user_id) DO UPDATE SET
+				flag_type = excluded.flag_type,
+				confidence = excluded.confidence,
+				reasons = excluded.reasons
+		`
 
-		if _, err := s.cfAPI.ExecuteSQL(ctx, sqlStmt, params); err != nil {
+		result, err := s.cfAPI.ExecuteSQL(ctx, sqlStmt, params)
+		if err != nil {
 			return fmt.Errorf("error executing D1 statement: %w", err)
 		}
+		s.rowsWritten.Add(result.TotalMeta().RowsWritten)
 	}
 
 	// Update progress after successful batch
@@ -0,0 +1,228 @@
+//go:build !js || !wasm
+
+package d1_test
+
+import (
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/robalyx/roscoe/internal/d1fake"
+	"github.com/robalyx/roscoe/internal/service/d1"
+
+	_ "modernc.org/sqlite"
+)
+
+// openMemoryDB opens an in-memory SQLite database. It is limited to one
+// connection, as every connection would otherwise get its own database.
+func openMemoryDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestD1 starts a fake D1 API backed by an in-memory database, returning a
+// client for it and the database to inspect.
+func newTestD1(t *testing.T) (*d1.CloudflareAPI, *sql.DB) {
+	t.Helper()
+
+	db := openMemoryDB(t)
+	server := httptest.NewServer(d1fake.NewServer(db, "token"))
+	t.Cleanup(server.Close)
+
+	cfAPI := d1.NewCloudflareAPI("account", "database", "token",
+		d1.WithBaseURL(server.URL), d1.WithRetryPolicy(d1.RetryPolicy{MaxAttempts: 1}))
+	return cfAPI, db
+}
+
+// newSourceDB creates a source database with the given flagged and confirmed users.
+func newSourceDB(t *testing.T, flagged, confirmed []int64) *sql.DB {
+	t.Helper()
+
+	db := openMemoryDB(t)
+	mustExec(t, db, `
+		CREATE TABLE flagged_users (id INTEGER PRIMARY KEY, confidence REAL, reasons TEXT);
+		CREATE TABLE confirmed_users (id INTEGER PRIMARY KEY, confidence REAL, reasons TEXT);
+	`)
+	for _, id := range flagged {
+		mustExec(t, db, `INSERT INTO flagged_users VALUES (?, 0.5, '{}')`, id)
+	}
+	for _, id := range confirmed {
+		mustExec(t, db, `INSERT INTO confirmed_users VALUES (?, 1, '{}')`, id)
+	}
+	return db
+}
+
+func mustExec(t *testing.T, db *sql.DB, query string, args ...any) {
+	t.Helper()
+
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("failed to run %q: %v", query, err)
+	}
+}
+
+func queryInt(t *testing.T, db *sql.DB, query string, args ...any) int64 {
+	t.Helper()
+
+	var value int64
+	if err := db.QueryRow(query, args...).Scan(&value); err != nil {
+		t.Fatalf("failed to run %q: %v", query, err)
+	}
+	return value
+}
+
+// userIDRange returns the IDs from first to last.
+func userIDRange(first, last int64) []int64 {
+	ids := make([]int64, 0, last-first+1)
+	for id := first; id <= last; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestUpdateFlagsFullAndDelta(t *testing.T) {
+	ctx := context.Background()
+	cfAPI, d1DB := newTestD1(t)
+	source := newSourceDB(t, userIDRange(1, 1200), userIDRange(5001, 5100))
+	syncService := d1.NewSyncService(source, cfAPI)
+
+	// A full sync publishes every user and records the run
+	err := syncService.UpdateFlags(ctx, d1.SyncOptions{
+		Full: true, MaxDropPercent: d1.DefaultMaxDropPercent, KeepSnapshots: 3, SourceHost: "source",
+	})
+	if err != nil {
+		t.Fatalf("full sync failed: %v", err)
+	}
+
+	if got := queryInt(t, d1DB, `SELECT COUNT(*) FROM user_flags WHERE flag_type = 1`); got != 1200 {
+		t.Errorf("flagged users in user_flags = %d, want 1200", got)
+	}
+	if got := queryInt(t, d1DB, `SELECT COUNT(*) FROM user_flags WHERE flag_type = 2`); got != 100 {
+		t.Errorf("confirmed users in user_flags = %d, want 100", got)
+	}
+	assertDatasetMeta(t, d1DB, 1, 1200, 100)
+	assertLastRun(t, d1DB, "full", d1.SyncOutcomeSuccess, 1300)
+
+	// A delta sync applies only the changes, and only keeps a snapshot to
+	// roll back to if asked to
+	snapshots := queryInt(t, d1DB, `SELECT COUNT(*) FROM flag_snapshots`)
+	mustExec(t, source, `UPDATE flagged_users SET confidence = 0.7 WHERE id = 12`)
+	err = syncService.UpdateFlags(ctx, d1.SyncOptions{MaxDropPercent: d1.DefaultMaxDropPercent, KeepSnapshots: 3})
+	if err != nil {
+		t.Fatalf("delta sync failed: %v", err)
+	}
+	if got := queryInt(t, d1DB, `SELECT COUNT(*) FROM flag_snapshots`); got != snapshots {
+		t.Errorf("snapshots after a delta sync = %d, want %d", got, snapshots)
+	}
+	assertLastRun(t, d1DB, "delta", d1.SyncOutcomeSuccess, 1300)
+
+	mustExec(t, source, `DELETE FROM flagged_users WHERE id <= 10`)
+	mustExec(t, source, `UPDATE flagged_users SET confidence = 0.9 WHERE id = 11`)
+	mustExec(t, source, `INSERT INTO confirmed_users VALUES (6000, 1, '{}')`)
+
+	err = syncService.UpdateFlags(ctx, d1.SyncOptions{
+		MaxDropPercent: d1.DefaultMaxDropPercent, KeepSnapshots: 3, SnapshotDelta: true,
+	})
+	if err != nil {
+		t.Fatalf("delta sync failed: %v", err)
+	}
+
+	if got := queryInt(t, d1DB, `SELECT COUNT(*) FROM user_flags`); got != 1291 {
+		t.Errorf("users in user_flags = %d, want 1291", got)
+	}
+	if got := queryInt(t, d1DB, `SELECT COUNT(*) FROM user_flags WHERE user_id <= 10`); got != 0 {
+		t.Errorf("removed users in user_flags = %d, want 0", got)
+	}
+	if got := queryInt(t, d1DB, `SELECT COUNT(*) FROM user_flags WHERE user_id = 6000 AND flag_type = 2`); got != 1 {
+		t.Errorf("new confirmed user in user_flags = %d, want 1", got)
+	}
+	if got := queryInt(t, d1DB, `SELECT CAST(confidence * 10 AS INTEGER) FROM user_flags WHERE user_id = 11`); got != 9 {
+		t.Errorf("updated confidence * 10 = %d, want 9", got)
+	}
+	assertDatasetMeta(t, d1DB, 3, 1190, 101)
+	assertLastRun(t, d1DB, "delta", d1.SyncOutcomeSuccess, 1291)
+
+	// Rolling back restores the dataset from before the last delta sync
+	snapshot, err := d1.NewSnapshotService(cfAPI).Rollback(ctx, "")
+	if err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	if snapshot.RowCount != 1300 {
+		t.Errorf("snapshot rows = %d, want 1300", snapshot.RowCount)
+	}
+	if got := queryInt(t, d1DB, `SELECT COUNT(*) FROM user_flags`); got != 1300 {
+		t.Errorf("users in user_flags after rollback = %d, want 1300", got)
+	}
+	assertDatasetMeta(t, d1DB, 4, 1200, 100)
+	if got := queryInt(t, d1DB, `SELECT CAST(confidence * 10 AS INTEGER) FROM user_flags WHERE user_id = 12`); got != 7 {
+		t.Errorf("confidence * 10 after rollback = %d, want 7", got)
+	}
+}
+
+func TestUpdateFlagsRejectsSuspiciousDrop(t *testing.T) {
+	ctx := context.Background()
+	cfAPI, d1DB := newTestD1(t)
+	source := newSourceDB(t, userIDRange(1, 100), nil)
+	syncService := d1.NewSyncService(source, cfAPI)
+
+	opts := d1.SyncOptions{Full: true, MaxDropPercent: d1.DefaultMaxDropPercent}
+	if err := syncService.UpdateFlags(ctx, opts); err != nil {
+		t.Fatalf("full sync failed: %v", err)
+	}
+
+	mustExec(t, source, `DELETE FROM flagged_users WHERE id > 50`)
+	if err := syncService.UpdateFlags(ctx, opts); err == nil {
+		t.Fatal("sync after a 50% drop succeeded, want an error")
+	}
+
+	if got := queryInt(t, d1DB, `SELECT COUNT(*) FROM user_flags`); got != 100 {
+		t.Errorf("users in user_flags = %d, want 100", got)
+	}
+	assertDatasetMeta(t, d1DB, 1, 100, 0)
+	assertLastRun(t, d1DB, "full", d1.SyncOutcomeFailed, 50)
+}
+
+func assertDatasetMeta(t *testing.T, db *sql.DB, version, flagged, confirmed int64) {
+	t.Helper()
+
+	var meta d1.DatasetMeta
+	err := db.QueryRow(`SELECT version, synced_at, flagged_count, confirmed_count FROM dataset_meta WHERE id = 1`).
+		Scan(&meta.Version, &meta.SyncedAt, &meta.FlaggedCount, &meta.ConfirmedCount)
+	if err != nil {
+		t.Fatalf("failed to read dataset_meta: %v", err)
+	}
+
+	if meta.Version != version || meta.FlaggedCount != flagged || meta.ConfirmedCount != confirmed {
+		t.Errorf("dataset_meta = version %d, %d flagged, %d confirmed, want version %d, %d flagged, %d confirmed",
+			meta.Version, meta.FlaggedCount, meta.ConfirmedCount, version, flagged, confirmed)
+	}
+	if !meta.SyncedAt.Valid {
+		t.Error("dataset_meta has no synced_at")
+	}
+}
+
+func assertLastRun(t *testing.T, db *sql.DB, mode, outcome string, total int64) {
+	t.Helper()
+
+	var run d1.SyncRun
+	err := db.QueryRow(`SELECT mode, outcome, total_count, rows_written FROM sync_runs ORDER BY id DESC LIMIT 1`).
+		Scan(&run.Mode, &run.Outcome, &run.TotalCount, &run.RowsWritten)
+	if err != nil {
+		t.Fatalf("failed to read sync_runs: %v", err)
+	}
+
+	if run.Mode != mode || run.Outcome != outcome || run.TotalCount != total {
+		t.Errorf("last sync run = %s/%s with %d users, want %s/%s with %d users",
+			run.Mode, run.Outcome, run.TotalCount, mode, outcome, total)
+	}
+	if outcome == d1.SyncOutcomeSuccess && run.RowsWritten == 0 {
+		t.Error("last sync run wrote no rows")
+	}
+}
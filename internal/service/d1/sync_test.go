@@ -0,0 +1,46 @@
+package d1
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiffRecords(t *testing.T) {
+	flagged := Record{userID: 1, flagType: 1, confidence: 0.5, reasons: "{}"}
+	confirmed := Record{userID: 2, flagType: 2, confidence: 1, reasons: "{}"}
+	newUser := Record{userID: 3, flagType: 1, confidence: 0.7, reasons: "{}"}
+	promoted := Record{userID: 1, flagType: 2, confidence: 0.5, reasons: "{}"}
+
+	tests := []struct {
+		name        string
+		live        []Record
+		records     []Record
+		wantUpserts []Record
+		wantDeletes []uint64
+	}{
+		{"no changes", []Record{flagged, confirmed}, []Record{flagged, confirmed}, nil, nil},
+		{"empty live dataset", nil, []Record{flagged, confirmed}, []Record{flagged, confirmed}, nil},
+		{"new user", []Record{flagged}, []Record{flagged, newUser}, []Record{newUser}, nil},
+		{"changed user", []Record{flagged, confirmed}, []Record{promoted, confirmed}, []Record{promoted}, nil},
+		{"removed user", []Record{flagged, confirmed}, []Record{confirmed}, nil, []uint64{1}},
+		{"everything removed", []Record{flagged, confirmed}, nil, nil, []uint64{1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := make(map[uint64]Record, len(tt.live))
+			for _, rec := range tt.live {
+				live[rec.userID] = rec
+			}
+
+			upserts, deletes := diffRecords(live, tt.records)
+			slices.Sort(deletes)
+			if !slices.Equal(upserts, tt.wantUpserts) {
+				t.Errorf("upserts = %v, want %v", upserts, tt.wantUpserts)
+			}
+			if !slices.Equal(deletes, tt.wantDeletes) {
+				t.Errorf("deletes = %v, want %v", deletes, tt.wantDeletes)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package d1
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const apiKeyUsageTableSQL = `
+	CREATE TABLE IF NOT EXISTS api_key_usage (
+		key_id INTEGER NOT NULL,
+		bucket_start INTEGER NOT NULL,
+		route TEXT NOT NULL,
+		requests INTEGER NOT NULL DEFAULT 0,
+		ids INTEGER NOT NULL DEFAULT 0,
+		flagged INTEGER NOT NULL DEFAULT 0,
+		errors INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (key_id, bucket_start, route)
+	);
+`
+
+const (
+	// UsageBucket is the length of the buckets usage is stored in.
+	UsageBucket = time.Hour
+
+	// usageFlushInterval and usageMaxPending decide when buffered usage is
+	// written to D1: once the interval has passed since the last write, or
+	// once this many counters are waiting.
+	usageFlushInterval = 30 * time.Second
+	usageMaxPending    = 50
+
+	// usageBatchSize is the number of counters written per statement, each
+	// binding seven parameters.
+	usageBatchSize = maxBoundParams / 7
+)
+
+// UsageCounts are the usage counters of an API key.
+type UsageCounts struct {
+	Requests int64
+	IDs      int64
+	Flagged  int64
+	Errors   int64
+}
+
+// add adds other to the counts.
+func (c *UsageCounts) add(other UsageCounts) {
+	c.Requests += other.Requests
+	c.IDs += other.IDs
+	c.Flagged += other.Flagged
+	c.Errors += other.Errors
+}
+
+// usageKey identifies a usage counter.
+type usageKey struct {
+	keyID       int64
+	bucketStart int64
+	route       string
+}
+
+// UsageRecorder buffers API key usage in memory and writes it to D1 in
+// batches, so requests don't each cost a write. Usage buffered by an isolate
+// that is shut down before flushing is lost.
+type UsageRecorder struct {
+	db        *sql.DB
+	mu        sync.Mutex
+	pending   map[usageKey]*UsageCounts
+	lastFlush time.Time
+}
+
+// NewUsageRecorder creates a new usage recorder.
+func NewUsageRecorder(db *sql.DB) *UsageRecorder {
+	return &UsageRecorder{
+		db:        db,
+		pending:   make(map[usageKey]*UsageCounts),
+		lastFlush: time.Now(),
+	}
+}
+
+// Record adds usage of a key on a route to the buffer. It reports whether
+// the buffer is due to be flushed.
+func (r *UsageRecorder) Record(keyID int64, route string, counts UsageCounts) bool {
+	now := time.Now()
+	key := usageKey{
+		keyID:       keyID,
+		bucketStart: now.Truncate(UsageBucket).Unix(),
+		route:       route,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if pending, ok := r.pending[key]; ok {
+		pending.add(counts)
+	} else {
+		r.pending[key] = &counts
+	}
+
+	return now.Sub(r.lastFlush) >= usageFlushInterval || len(r.pending) >= usageMaxPending
+}
+
+// Flush writes the buffered usage to D1. Usage that fails to be written is
+// kept in the buffer for the next flush.
+func (r *UsageRecorder) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[usageKey]*UsageCounts)
+	r.lastFlush = time.Now()
+	r.mu.Unlock()
+
+	keys := make([]usageKey, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+
+	for i := 0; i < len(keys); i += usageBatchSize {
+		end := i + usageBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		if err := r.writeBatch(ctx, keys[i:end], pending); err != nil {
+			r.restore(keys[i:], pending)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InitUsageTable ensures the usage table exists.
+func (r *UsageRecorder) InitUsageTable(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, apiKeyUsageTableSQL)
+	return err
+}
+
+// writeBatch adds the given counters to the usage table.
+func (r *UsageRecorder) writeBatch(ctx context.Context, keys []usageKey, pending map[usageKey]*UsageCounts) error {
+	var query strings.Builder
+	query.WriteString("INSERT INTO api_key_usage (key_id, bucket_start, route, requests, ids, flagged, errors) VALUES ")
+	params := make([]any, 0, len(keys)*7)
+	for i, key := range keys {
+		if i > 0 {
+			query.WriteString(",")
+		}
+		query.WriteString("(?, ?, ?, ?, ?, ?, ?)")
+
+		counts := pending[key]
+		params = append(params, key.keyID, key.bucketStart, key.route,
+			counts.Requests, counts.IDs, counts.Flagged, counts.Errors)
+	}
+	query.WriteString(`
+		ON CONFLICT (key_id, bucket_start, route) DO UPDATE SET
+			requests = requests + excluded.requests,
+			ids = ids + excluded.ids,
+			flagged = flagged + excluded.flagged,
+			errors = errors + excluded.errors
+	`)
+
+	if _, err := r.db.ExecContext(ctx, query.String(), params...); err != nil {
+		return fmt.Errorf("error writing API key usage: %w", err)
+	}
+	return nil
+}
+
+// restore puts counters that failed to be written back into the buffer.
+func (r *UsageRecorder) restore(keys []usageKey, pending map[usageKey]*UsageCounts) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, key := range keys {
+		if current, ok := r.pending[key]; ok {
+			current.add(*pending[key])
+		} else {
+			r.pending[key] = pending[key]
+		}
+	}
+}
+
+// UsageRow is the usage of an API key on a route during one period.
+type UsageRow struct {
+	KeyID       int64
+	Prefix      string
+	Description string
+	PeriodStart int64
+	Route       string
+	UsageCounts
+}
+
+// UsageQuery selects the usage to report.
+type UsageQuery struct {
+	// KeyRef limits the report to one key by ID, prefix or full key.
+	KeyRef string
+
+	// Since is the Unix time usage is reported from.
+	Since int64
+
+	// Period is the length of the periods usage is grouped into, a multiple
+	// of UsageBucket.
+	Period time.Duration
+}
+
+// UsageService reads API key usage from D1.
+type UsageService struct {
+	cfAPI *CloudflareAPI
+}
+
+// NewUsageService creates a new usage service.
+func NewUsageService(cfAPI *CloudflareAPI) *UsageService {
+	return &UsageService{
+		cfAPI: cfAPI,
+	}
+}
+
+// Report returns the usage selected by query, ordered by period, key and route.
+func (s *UsageService) Report(ctx context.Context, query UsageQuery) ([]UsageRow, error) {
+	if _, err := s.cfAPI.ExecuteSQL(ctx, apiKeyUsageTableSQL, nil); err != nil {
+		return nil, fmt.Errorf("error creating usage table: %w", err)
+	}
+
+	period := int64(max(query.Period, UsageBucket) / time.Second)
+	reportSQL := `
+		SELECT u.key_id, k.prefix, k.description, (u.bucket_start / ?) * ? AS period_start, u.route,
+			SUM(u.requests) AS requests, SUM(u.ids) AS ids, SUM(u.flagged) AS flagged, SUM(u.errors) AS errors
+		FROM api_key_usage u LEFT JOIN api_keys k ON k.id = u.key_id
+		WHERE u.bucket_start >= ?
+	`
+	params := []any{period, period, (query.Since / period) * period}
+	if query.KeyRef != "" {
+		reportSQL += " AND u.key_id IN (SELECT id FROM api_keys WHERE " + KeyRefCondition + ")"
+		params = append(params, KeyRefParams(query.KeyRef)...)
+	}
+	reportSQL += " GROUP BY u.key_id, period_start, u.route ORDER BY period_start, u.key_id, u.route"
+
+	result, err := s.cfAPI.ExecuteSQL(ctx, reportSQL, params)
+	if err != nil {
+		return nil, fmt.Errorf("error querying usage: %w", err)
+	}
+
+	rows := result.Rows()
+	usage := make([]UsageRow, 0, len(rows))
+	for _, row := range rows {
+		entry := UsageRow{
+			KeyID:       int64(row["key_id"].(float64)),
+			PeriodStart: int64(row["period_start"].(float64)),
+			Route:       row["route"].(string),
+			UsageCounts: UsageCounts{
+				Requests: int64(row["requests"].(float64)),
+				IDs:      int64(row["ids"].(float64)),
+				Flagged:  int64(row["flagged"].(float64)),
+				Errors:   int64(row["errors"].(float64)),
+			},
+		}
+		entry.Prefix, _ = row["prefix"].(string)
+		entry.Description, _ = row["description"].(string)
+		usage = append(usage, entry)
+	}
+
+	return usage, nil
+}
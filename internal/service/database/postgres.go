@@ -15,8 +15,14 @@ type Client struct {
 
 // NewClient creates a new database client.
 func NewClient(ctx context.Context, url string) (*Client, error) {
+	return NewClientWithDriver(ctx, "postgres", url)
+}
+
+// NewClientWithDriver creates a new database client using the given
+// database/sql driver, which must already be registered.
+func NewClientWithDriver(ctx context.Context, driverName, url string) (*Client, error) {
 	// Open the database
-	db, err := sql.Open("postgres", url)
+	db, err := sql.Open(driverName, url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}